@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/joeshaw/envdecode"
 	"github.com/joho/godotenv"
@@ -25,9 +26,22 @@ const (
 	FEED_SIZE_MAX                = 48
 	CTX_DB_TX_KEY                = "db_tx"
 	CTX_REQ_KEY                  = "req"
+	CTX_REQ_ID_KEY               = "req_id"
+	CTX_LOG_KEY                  = "log"
+	CTX_REC_REW_KEY              = "rec_rew"
+	REQ_ID_HEADER                = "x-request-id"
+	REQ_ID_MAX_LEN               = 128
 	PRETTY_PRINT_INDENT          = "  "
 	LOWERCASE_LETTERS            = "abcdefghijklmnopqrstuvwxyz"
 	LOWERCASE_LETTERS_AND_DIGITS = LOWERCASE_LETTERS + "0123456789"
+	ERR_MSG_UNEXPECTED           = "Unexpected Error"
+	RETRY_AFTER_SECONDS          = 1
+	DB_SCHEMA_TBL_PATH           = "sql/schema_tbl.pgsql"
+	DB_MIGRATIONS_PATH           = "sql/migrations.pgsql"
+	DB_MIGRATIONS_DIR            = "sql/migrations"
+	DB_SCHEMA_EPH_PATH           = "sql/schema_eph.pgsql"
+	DB_SCHEMA_BASELINE_PATH      = "sql/schema_baseline.pgsql"
+	DB_LINT_EXCEPTIONS_PATH      = "sql/schema_lint_exceptions.txt"
 )
 
 var (
@@ -49,6 +63,111 @@ type Conf struct {
 	PrettyJson         bool          `env:"PRETTY_JSON"`
 	PrettyXml          bool          `env:"PRETTY_XML"`
 	PrettySql          bool          `env:"PRETTY_SQL"`
+
+	// Connection settings. See https://www.postgresql.org/docs/current/libpq-connect.html
+	// for the SSL modes. The certificate paths are optional.
+	PostgresSslMode         string        `env:"POSTGRES_SSL_MODE,default=disable"`
+	PostgresSslRootCert     string        `env:"POSTGRES_SSL_ROOT_CERT"`
+	PostgresSslCert         string        `env:"POSTGRES_SSL_CERT"`
+	PostgresSslKey          string        `env:"POSTGRES_SSL_KEY"`
+	PostgresConnectTimeout  time.Duration `env:"POSTGRES_CONNECT_TIMEOUT,default=10s"`
+	PostgresApplicationName string        `env:"POSTGRES_APPLICATION_NAME,default=starter"`
+
+	// Connection pool settings. See the corresponding methods of `sql.DB`. Zero
+	// means no limit.
+	PostgresMaxOpenConns    int           `env:"POSTGRES_MAX_OPEN_CONNS,default=25"`
+	PostgresMaxIdleConns    int           `env:"POSTGRES_MAX_IDLE_CONNS,default=25"`
+	PostgresConnMaxLifetime time.Duration `env:"POSTGRES_CONN_MAX_LIFETIME,default=30m"`
+	PostgresConnMaxIdleTime time.Duration `env:"POSTGRES_CONN_MAX_IDLE_TIME,default=5m"`
+
+	// How long to keep retrying on startup while the DB is unreachable. Zero
+	// means a single attempt. See `pingDb`.
+	PostgresStartupTimeout time.Duration `env:"POSTGRES_STARTUP_TIMEOUT,default=60s"`
+
+	// Optional read replica for read-only transactions; see `dbForTx`. Empty
+	// host disables it. Other connection and pool settings are shared with the
+	// primary. Locally, it may point to the same DB as the primary. The replica
+	// is taken out of rotation while its replication lag exceeds the maximum;
+	// zero disables the lag check. See `dbReplicaHealth`.
+	PostgresReplicaHost          string        `env:"POSTGRES_REPLICA_HOST"`
+	PostgresReplicaPort          string        `env:"POSTGRES_REPLICA_PORT"`
+	PostgresReplicaCheckInterval time.Duration `env:"POSTGRES_REPLICA_CHECK_INTERVAL,default=10s"`
+	PostgresReplicaMaxLag        time.Duration `env:"POSTGRES_REPLICA_MAX_LAG,default=30s"`
+
+	// Render JSON errors as RFC 7807 "application/problem+json". See `writeErr`.
+	ProblemJson bool `env:"PROBLEM_JSON"`
+
+	// Human-readable messages for DB codes. See `DbMessages`.
+	DbMessagesPath string `env:"DB_MESSAGES_PATH,default=sql/db_messages.json"`
+	DefaultLocale  string `env:"DEFAULT_LOCALE,default=en"`
+
+	// How long to wait for in-flight requests on shutdown before canceling
+	// their contexts.
+	ServerShutdownTimeout time.Duration `env:"SERVER_SHUTDOWN_TIMEOUT,default=20s"`
+
+	// See the corresponding fields of `http.Server`. Zero means no timeout. The
+	// write timeout also limits streaming responses; see `NdjsonRes`.
+	ServerReadHeaderTimeout time.Duration `env:"SERVER_READ_HEADER_TIMEOUT,default=10s"`
+	ServerReadTimeout       time.Duration `env:"SERVER_READ_TIMEOUT,default=60s"`
+	ServerWriteTimeout      time.Duration `env:"SERVER_WRITE_TIMEOUT,default=60s"`
+	ServerIdleTimeout       time.Duration `env:"SERVER_IDLE_TIMEOUT,default=120s"`
+
+	// On shutdown, the readiness check fails for this long before the server
+	// stops accepting connections, giving load balancers time to notice. Should
+	// exceed the readiness probe period. Together with `ServerShutdownTimeout`,
+	// must fit in the termination grace period of the pod (30s by default in
+	// Kubernetes); the defaults leave 5s for closing the DB pool. Raising either
+	// requires raising `terminationGracePeriodSeconds`. Zero skips draining,
+	// which is convenient for local development.
+	ServerDrainDelay time.Duration `env:"SERVER_DRAIN_DELAY,default=5s"`
+
+	// Timeout for all dependency checks of `apiHealthReady`.
+	HealthCheckTimeout time.Duration `env:"HEALTH_CHECK_TIMEOUT,default=2s"`
+
+	// Maximum size of a request body, in bytes. Zero means no limit.
+	ServerMaxBodySize int64 `env:"SERVER_MAX_BODY_SIZE,default=10485760"`
+
+	// Serve "index.html" when browsers navigate to unknown paths without an
+	// extension outside "/api", for single-page apps with client-side routing.
+	// See `serveStatic`.
+	StaticSpaFallback bool `env:"STATIC_SPA_FALLBACK"`
+
+	// Static files whose paths match this regexp are considered fingerprinted
+	// and cached indefinitely. See `serveStatic`. The default matches hashes of
+	// at least 8 base64url characters before the extensions, as produced by
+	// Vite, esbuild and webpack, for example "/assets/index-BkP3x_9a.js". Such
+	// hashes can't be told apart from ordinary words, so the default is limited
+	// to the usual build output directories, which must contain only
+	// fingerprinted files. Everything in "/_next/static" is fingerprinted.
+	StaticImmutablePattern string `env:"STATIC_IMMUTABLE_PATTERN,default=^/(?:_next/static/|(?:assets|static|build)/.*[.-][A-Za-z0-9_-]{8}[A-Za-z0-9_-]*(?:\\.\\w+)+$)"`
+
+	// CORS policy, see `allowCors`. Lists are separated with ";". Origins are
+	// exact or patterns in the syntax of `path.Match`, for example
+	// "https://*.example.com". "*" allows any origin, and can't be combined
+	// with credentials, which would let any site make requests on behalf of
+	// our users. Empty means cross-origin requests are not allowed.
+	CorsOrigins       []string      `env:"CORS_ORIGINS"`
+	CorsMethods       []string      `env:"CORS_METHODS,default=OPTIONS;GET;HEAD;POST;PUT;PATCH;DELETE"`
+	CorsHeaders       []string      `env:"CORS_HEADERS,default=content-type;x-request-id"`
+	CorsExposeHeaders []string      `env:"CORS_EXPOSE_HEADERS,default=x-request-id;retry-after;content-language"`
+	CorsCredentials   bool          `env:"CORS_CREDENTIALS"`
+	CorsMaxAge        time.Duration `env:"CORS_MAX_AGE,default=10m"`
+
+	// Responses are compressed when their media type matches one of these
+	// patterns (in the syntax of `path.Match`) and their size is at least
+	// `CompressMinSize` bytes. Empty disables compression. See `CompressRew`.
+	CompressTypes   []string `env:"COMPRESS_TYPES,default=text/*;application/json;application/problem+json;application/x-ndjson;application/javascript;application/xml;application/manifest+json;application/wasm;image/svg+xml"`
+	CompressMinSize int      `env:"COMPRESS_MIN_SIZE,default=1024"`
+
+	// Bearer token required by "/metrics", for example via "bearer_token" in the
+	// Prometheus scrape config. Empty disables the endpoint. See `serveMetrics`.
+	MetricsToken string `env:"METRICS_TOKEN"`
+
+	// Fraction of requests to include in the access log, between 0 and 1.
+	// Server errors are always logged. Excluded paths are never logged; they're
+	// separated with ";". See `logAccess`.
+	AccessLogSampleRate float64  `env:"ACCESS_LOG_SAMPLE_RATE,default=1"`
+	AccessLogExclude    []string `env:"ACCESS_LOG_EXCLUDE,default=/api/v1;/api/v1/health/live;/api/v1/health/ready;/metrics"`
 }
 
 func (self *Conf) Init() error {
@@ -70,22 +189,54 @@ func (self *Conf) Init() error {
 
 func (self Conf) PostgresConnString() string {
 	vals := []string{
-		"host=" + self.PostgresDbHost,
-		"dbname=" + self.PostgresDbName,
-		"sslmode=disable",
-		"user=" + self.PostgresUser,
-		"search_path=" + self.PostgresSearchPath,
-		"timezone=UTC",
+		pgConnParam("host", self.PostgresDbHost),
+		pgConnParam("dbname", self.PostgresDbName),
+		pgConnParam("sslmode", self.PostgresSslMode),
+		pgConnParam("user", self.PostgresUser),
+		pgConnParam("search_path", self.PostgresSearchPath),
+		pgConnParam("timezone", "UTC"),
 	}
-	if self.PostgresPassword != "" {
-		vals = append(vals, "password="+self.PostgresPassword)
+
+	optional := [][2]string{
+		{"password", self.PostgresPassword},
+		{"port", self.PostgresDbPort},
+		{"sslrootcert", self.PostgresSslRootCert},
+		{"sslcert", self.PostgresSslCert},
+		{"sslkey", self.PostgresSslKey},
+		{"application_name", self.PostgresApplicationName},
+	}
+	for _, pair := range optional {
+		if pair[1] != "" {
+			vals = append(vals, pgConnParam(pair[0], pair[1]))
+		}
 	}
-	if self.PostgresDbPort != "" {
-		vals = append(vals, "port="+self.PostgresDbPort)
+
+	// Measured in seconds; zero means no timeout, so we round up.
+	if self.PostgresConnectTimeout > 0 {
+		seconds := int64((self.PostgresConnectTimeout + time.Second - 1) / time.Second)
+		vals = append(vals, pgConnParam("connect_timeout", intToString(seconds)))
 	}
+
 	return strings.Join(vals, " ")
 }
 
+// Config for connecting to the read replica instead of the primary.
+func (self Conf) ReplicaConf() Conf {
+	self.PostgresDbHost = self.PostgresReplicaHost
+	self.PostgresDbPort = self.PostgresReplicaPort
+	return self
+}
+
+/*
+Values are quoted because they may contain spaces, for example in passwords or
+file paths.
+*/
+func pgConnParam(key string, val string) string {
+	return key + "='" + pgConnParamReplacer.Replace(val) + "'"
+}
+
+var pgConnParamReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
 func (self Conf) TryLogger() *zap.SugaredLogger {
 	var logConf zap.Config
 	if self.DevelopmentMode {
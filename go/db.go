@@ -2,18 +2,88 @@ package main
 
 import (
 	"database/sql"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/mitranim/try"
+	"github.com/pkg/errors"
+)
+
+// Bounds of the exponential backoff of `pingDb`.
+const (
+	DB_STARTUP_RETRY_DELAY_MIN = 250 * time.Millisecond
+	DB_STARTUP_RETRY_DELAY_MAX = 5 * time.Second
 )
 
 func initDb() (err error) {
 	defer try.Rec(&err)
 
-	conn, err := sql.Open("postgres", env.conf.PostgresConnString())
+	conn, err := openDb(env.conf)
 	try.To(err)
-	try.To(conn.Ping())
+
+	err = pingDb(conn)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
 	env.db = conn
+	return initDbReplica()
+}
+
+/*
+Creates a connection pool configured by `Conf`. Doesn't connect; see
+`pingDb`.
+*/
+func openDb(conf Conf) (*sql.DB, error) {
+	conn, err := sql.Open("postgres", conf.PostgresConnString())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	conn.SetMaxOpenConns(conf.PostgresMaxOpenConns)
+	conn.SetMaxIdleConns(conf.PostgresMaxIdleConns)
+	conn.SetConnMaxLifetime(conf.PostgresConnMaxLifetime)
+	conn.SetConnMaxIdleTime(conf.PostgresConnMaxIdleTime)
+	return conn, nil
+}
+
+/*
+Pings the DB until it responds, with exponential backoff, for up to
+`Conf.PostgresStartupTimeout`. This allows the app to start before the DB,
+which is common in Kubernetes and docker-compose. Errors reported by a running
+DB, such as bad credentials, are not retried, except when it's still starting
+up.
+*/
+func pingDb(conn *sql.DB) error {
+	deadline := time.Now().Add(env.conf.PostgresStartupTimeout)
+	delay := DB_STARTUP_RETRY_DELAY_MIN
+
+	for {
+		err := errors.WithStack(conn.Ping())
+		if err == nil {
+			return nil
+		}
+
+		if !isErrDbUnreachable(err) || time.Now().Add(delay).After(deadline) {
+			return errors.WithMessagef(err, `failed to connect to the DB within %v`, env.conf.PostgresStartupTimeout)
+		}
+
+		env.log.Warnf("failed to connect to the DB, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > DB_STARTUP_RETRY_DELAY_MAX {
+			delay = DB_STARTUP_RETRY_DELAY_MAX
+		}
+	}
+}
+
+// Should be called only after the server has stopped serving requests.
+func closeDb() error {
+	logError(closeDbReplica())
 
-	return nil
+	if env.db == nil {
+		return nil
+	}
+	return errors.Wrap(env.db.Close(), `failed to close DB connection pool`)
 }
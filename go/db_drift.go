@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mitranim/try"
+	"github.com/pkg/errors"
+)
+
+/*
+Detects drift between `schema_tbl.pgsql` and migrations. Builds two temporary
+databases: one from `schema_tbl.pgsql`, and one by applying all migrations to
+`schema_baseline.pgsql`. Then compares their catalogs and fails with a report
+if they differ. Requires permission to create databases. Usage:
+
+	go run ./go db_drift
+	./misc/pg_verify_drift
+*/
+func cmdDbDrift() (err error) {
+	defer try.Rec(&err)
+
+	try.To(initDb())
+	defer func() { logError(closeDb()) }()
+
+	ctx := ctxDefault()
+
+	fromSchema, err := dbDriftCatalog(ctx, func(ctx Ctx, conn *sql.DB) error {
+		return dbExecFile(ctx, conn, DB_SCHEMA_TBL_PATH)
+	})
+	try.To(err)
+
+	fromMigrations, err := dbDriftCatalog(ctx, func(ctx Ctx, conn *sql.DB) error {
+		tx, err := beginTx(ctx, conn)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		err = dbExecFiles(ctx, tx, []string{DB_SCHEMA_BASELINE_PATH, DB_MIGRATIONS_PATH})
+		if err != nil {
+			return err
+		}
+
+		err = dbRunMigrations(ctx, tx, false)
+		if err != nil {
+			return err
+		}
+		return errors.WithStack(tx.Commit())
+	})
+	try.To(err)
+
+	diff := diffDbCatalogs(fromSchema, fromMigrations)
+	if diff.IsEmpty() {
+		env.log.Info("no drift between ", DB_SCHEMA_TBL_PATH, " and migrations")
+		return nil
+	}
+
+	diff.WriteReport(os.Stdout)
+	return errors.Errorf(`%v differs from the result of applying migrations to %v`,
+		DB_SCHEMA_TBL_PATH, DB_SCHEMA_BASELINE_PATH)
+}
+
+/*
+Creates a temporary database, prepares it with the given function, reads its
+catalog, then drops the database.
+*/
+func dbDriftCatalog(ctx Ctx, fun func(Ctx, *sql.DB) error) (_ []DbCatalogEntry, err error) {
+	defer try.Rec(&err)
+
+	conf := env.conf
+	conf.PostgresDbName = env.conf.PostgresDbName + "_drift_" + randomLetters(8)
+	name := pq.QuoteIdentifier(conf.PostgresDbName)
+
+	try.To(dbExec(ctx, env.db, `create database `+name, nil))
+	defer func() {
+		logError(dbExec(ctx, env.db, `drop database if exists `+name, nil))
+	}()
+
+	conn, err := openDb(conf)
+	try.To(err)
+	defer conn.Close()
+
+	// The SQL files set the search path, which is a session setting.
+	conn.SetMaxOpenConns(1)
+
+	try.To(fun(ctx, conn))
+	return dbCatalog(ctx, conn)
+}
+
+/*
+Describes a single entity in the persistent schema. Column order is ignored
+because migrations can only append columns.
+*/
+type DbCatalogEntry struct {
+	Kind string `db:"kind"`
+	Name string `db:"name"`
+	Def  string `db:"def"`
+}
+
+func (self DbCatalogEntry) Key() string { return self.Kind + " " + self.Name }
+
+func dbCatalog(ctx Ctx, conn DbConn) ([]DbCatalogEntry, error) {
+	var out []DbCatalogEntry
+	err := SqlQueryOrd(dbCatalogQuery).Query(ctx, conn, &out)
+	return out, err
+}
+
+const dbCatalogQuery = `
+select kind, name, def from (
+  select
+    'table'   as kind,
+    c.relname as name,
+    ''        as def
+  from pg_class as c
+  join pg_namespace as n on n.oid = c.relnamespace
+  where n.nspname = 'tbl' and c.relkind in ('r', 'p')
+
+  union all
+
+  select
+    'column',
+    c.relname || '.' || a.attname,
+    format_type(a.atttypid, a.atttypmod)
+    || case when a.attnotnull then ' not null' else ' null' end
+    || coalesce(' default ' || pg_get_expr(d.adbin, d.adrelid), '')
+  from pg_attribute as a
+  join pg_class as c on c.oid = a.attrelid
+  join pg_namespace as n on n.oid = c.relnamespace
+  left join pg_attrdef as d on d.adrelid = a.attrelid and d.adnum = a.attnum
+  where n.nspname = 'tbl' and c.relkind in ('r', 'p') and a.attnum > 0 and not a.attisdropped
+
+  union all
+
+  select
+    'type',
+    t.typname,
+    case t.typtype
+      when 'e' then 'enum (' || (
+        select string_agg(e.enumlabel, ', ' order by e.enumsortorder)
+        from pg_enum as e
+        where e.enumtypid = t.oid
+      ) || ')'
+      else 'domain ' || format_type(t.typbasetype, t.typtypmod)
+        || case when t.typnotnull then ' not null' else '' end
+    end
+  from pg_type as t
+  join pg_namespace as n on n.oid = t.typnamespace
+  where n.nspname = 'tbl' and t.typtype in ('e', 'd')
+
+  union all
+
+  select
+    'constraint',
+    coalesce(c.relname, t.typname) || '.' || k.conname,
+    pg_get_constraintdef(k.oid)
+  from pg_constraint as k
+  join pg_namespace as n on n.oid = k.connamespace
+  left join pg_class as c on c.oid = k.conrelid
+  left join pg_type as t on t.oid = k.contypid
+  where n.nspname = 'tbl'
+
+  union all
+
+  select
+    'index',
+    i.tablename || '.' || i.indexname,
+    i.indexdef
+  from pg_indexes as i
+  where i.schemaname = 'tbl'
+
+  union all
+
+  select
+    'trigger',
+    c.relname || '.' || g.tgname,
+    pg_get_triggerdef(g.oid)
+  from pg_trigger as g
+  join pg_class as c on c.oid = g.tgrelid
+  join pg_namespace as n on n.oid = c.relnamespace
+  where n.nspname = 'tbl' and not g.tgisinternal
+
+  union all
+
+  select
+    'function',
+    p.proname || '(' || pg_get_function_identity_arguments(p.oid) || ')',
+    'md5 ' || md5(pg_get_functiondef(p.oid))
+  from pg_proc as p
+  join pg_namespace as n on n.oid = p.pronamespace
+  where n.nspname = 'tbl' and not exists(
+    select from pg_depend as d where d.objid = p.oid and d.deptype = 'e'
+  )
+) as _
+order by kind, name
+`
+
+type DbCatalogDiff struct {
+	Missing []DbCatalogEntry
+	Extra   []DbCatalogEntry
+	Changed [][2]DbCatalogEntry
+}
+
+func (self DbCatalogDiff) IsEmpty() bool {
+	return len(self.Missing) == 0 && len(self.Extra) == 0 && len(self.Changed) == 0
+}
+
+/*
+"Missing" entries are present in the schema but not in the migrated database.
+"Extra" entries are present in the migrated database but not in the schema.
+*/
+func diffDbCatalogs(schema []DbCatalogEntry, migrated []DbCatalogEntry) (out DbCatalogDiff) {
+	migratedByKey := map[string]DbCatalogEntry{}
+	for _, entry := range migrated {
+		migratedByKey[entry.Key()] = entry
+	}
+
+	schemaKeys := map[string]bool{}
+	for _, entry := range schema {
+		schemaKeys[entry.Key()] = true
+
+		other, ok := migratedByKey[entry.Key()]
+		if !ok {
+			out.Missing = append(out.Missing, entry)
+		} else if other.Def != entry.Def {
+			out.Changed = append(out.Changed, [2]DbCatalogEntry{entry, other})
+		}
+	}
+
+	for _, entry := range migrated {
+		if !schemaKeys[entry.Key()] {
+			out.Extra = append(out.Extra, entry)
+		}
+	}
+	return
+}
+
+func (self DbCatalogDiff) WriteReport(out io.Writer) {
+	if len(self.Missing) > 0 {
+		fmt.Fprintf(out, "in %v, but not produced by migrations:\n", DB_SCHEMA_TBL_PATH)
+		for _, entry := range self.Missing {
+			fmt.Fprintf(out, "%v%v: %v\n", PRETTY_PRINT_INDENT, entry.Key(), entry.Def)
+		}
+	}
+
+	if len(self.Extra) > 0 {
+		fmt.Fprintf(out, "produced by migrations, but not in %v:\n", DB_SCHEMA_TBL_PATH)
+		for _, entry := range self.Extra {
+			fmt.Fprintf(out, "%v%v: %v\n", PRETTY_PRINT_INDENT, entry.Key(), entry.Def)
+		}
+	}
+
+	if len(self.Changed) > 0 {
+		fmt.Fprintln(out, "defined differently:")
+		indent := strings.Repeat(PRETTY_PRINT_INDENT, 2)
+		for _, pair := range self.Changed {
+			fmt.Fprintf(out, "%v%v\n", PRETTY_PRINT_INDENT, pair[0].Key())
+			fmt.Fprintf(out, "%vschema:     %v\n", indent, pair[0].Def)
+			fmt.Fprintf(out, "%vmigrations: %v\n", indent, pair[1].Def)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/mitranim/try"
+	"github.com/pkg/errors"
+)
+
+/*
+Checks the persistent schema against the guidelines in `schema_tbl.pgsql`, by
+inspecting the catalog of the configured database (run `db_update` first) and,
+for things invisible in the catalog, the source of `schema_tbl.pgsql`. Reports
+every violation not declared in `DB_LINT_EXCEPTIONS_PATH`. Usage:
+
+	go run ./go db_lint
+*/
+func cmdDbLint() (err error) {
+	defer try.Rec(&err)
+
+	try.To(initDb())
+	defer func() { logError(closeDb()) }()
+
+	exceptions, err := readDbLintExceptions(DB_LINT_EXCEPTIONS_PATH)
+	try.To(err)
+
+	violations, err := dbLint(ctxDefault(), env.db)
+	try.To(err)
+
+	var count int
+	for _, val := range violations {
+		if exceptions.Allows(val) {
+			continue
+		}
+		count++
+		fmt.Println(val)
+	}
+
+	if count > 0 {
+		return errors.Errorf(`found %v schema guideline violations; see the guidelines in %v; `+
+			`exceptions may be declared in %v`, count, DB_SCHEMA_TBL_PATH, DB_LINT_EXCEPTIONS_PATH)
+	}
+	env.log.Info("no schema guideline violations")
+	return nil
+}
+
+type DbLintRule string
+
+const (
+	DbLintRuleTablePlural    DbLintRule = "table_plural"
+	DbLintRuleIdBigserial    DbLintRule = "id_bigserial"
+	DbLintRuleTimed          DbLintRule = "timed"
+	DbLintRuleTouchTrigger   DbLintRule = "touch_trigger"
+	DbLintRuleTimestamptz    DbLintRule = "timestamptz"
+	DbLintRuleTimeSuffix     DbLintRule = "time_suffix"
+	DbLintRuleBoolPrefix     DbLintRule = "bool_prefix"
+	DbLintRuleBigint         DbLintRule = "bigint"
+	DbLintRuleConstraintName DbLintRule = "constraint_name"
+	DbLintRuleIndexName      DbLintRule = "index_name"
+	DbLintRuleForeignKey     DbLintRule = "foreign_key"
+	DbLintRuleExplicitNull   DbLintRule = "explicit_null"
+)
+
+/*
+The object is "<table>", "<table>.<column>", "<table>.<constraint>", etc.,
+depending on the rule.
+*/
+type DbLintViolation struct {
+	Rule    DbLintRule
+	Object  string
+	Message string
+}
+
+func (self DbLintViolation) String() string {
+	return fmt.Sprintf(`%-16v %v: %v`, self.Rule, self.Object, self.Message)
+}
+
+/*
+Exceptions are declared one per line as "<rule> <object_pattern>", where the
+pattern uses the syntax of `path.Match`. Empty lines and lines starting with
+"#" are ignored. Example:
+
+	# Stripe objects have their own naming.
+	time_suffix stripe_*.created
+	bool_prefix stripe_*.*
+*/
+type DbLintExceptions []DbLintException
+
+type DbLintException struct {
+	Rule    DbLintRule
+	Pattern string
+}
+
+func readDbLintExceptions(filePath string) (out DbLintExceptions, err error) {
+	file, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf(`%v:%v: expected "<rule> <object_pattern>", got %q`, filePath, lineNum, line)
+		}
+		if _, err := path.Match(fields[1], ""); err != nil {
+			return nil, errors.Wrapf(err, `%v:%v: invalid pattern %q`, filePath, lineNum, fields[1])
+		}
+
+		out = append(out, DbLintException{DbLintRule(fields[0]), fields[1]})
+	}
+	return out, errors.WithStack(scanner.Err())
+}
+
+func (self DbLintExceptions) Allows(val DbLintViolation) bool {
+	for _, exc := range self {
+		if exc.Rule != val.Rule {
+			continue
+		}
+		ok, _ := path.Match(exc.Pattern, val.Object)
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func dbLint(ctx Ctx, conn DbConn) (out []DbLintViolation, err error) {
+	defer try.Rec(&err)
+
+	add := func(rule DbLintRule, object string, msg string, args ...interface{}) {
+		out = append(out, DbLintViolation{rule, object, fmt.Sprintf(msg, args...)})
+	}
+
+	var tables []struct {
+		Name            string `db:"name"`
+		HasTouchTrigger bool   `db:"has_touch_trigger"`
+	}
+	try.To(SqlQueryOrd(`
+		select
+			c.relname as name,
+			exists(
+				select from pg_trigger as g
+				join pg_proc as p on p.oid = g.tgfoid
+				where g.tgrelid = c.oid and not g.tgisinternal and p.proname = 'touch_updated_at'
+			) as has_touch_trigger
+		from pg_class as c
+		join pg_namespace as n on n.oid = c.relnamespace
+		where n.nspname = 'tbl' and c.relkind in ('r', 'p')
+		order by c.relname
+	`).Query(ctx, conn, &tables))
+
+	var cols []struct {
+		Table   string `db:"table_name"`
+		Name    string `db:"name"`
+		Type    string `db:"type"`
+		Default string `db:"default_expr"`
+	}
+	try.To(SqlQueryOrd(`
+		select
+			c.relname                                     as table_name,
+			a.attname                                     as name,
+			format_type(a.atttypid, a.atttypmod)          as type,
+			coalesce(pg_get_expr(d.adbin, d.adrelid), '') as default_expr
+		from pg_attribute as a
+		join pg_class as c on c.oid = a.attrelid
+		join pg_namespace as n on n.oid = c.relnamespace
+		left join pg_attrdef as d on d.adrelid = a.attrelid and d.adnum = a.attnum
+		where n.nspname = 'tbl' and c.relkind in ('r', 'p') and a.attnum > 0 and not a.attisdropped
+		order by c.relname, a.attnum
+	`).Query(ctx, conn, &cols))
+
+	colTypes := map[string]string{}
+	colDefaults := map[string]string{}
+	for _, col := range cols {
+		colTypes[col.Table+"."+col.Name] = col.Type
+		colDefaults[col.Table+"."+col.Name] = col.Default
+	}
+
+	for _, table := range tables {
+		if !isPluralIdent(table.Name) {
+			add(DbLintRuleTablePlural, table.Name, `table names must be plural`)
+		}
+
+		typ, ok := colTypes[table.Name+".id"]
+		if !ok {
+			add(DbLintRuleIdBigserial, table.Name, `missing column "id"`)
+		} else if typ != "bigint" {
+			add(DbLintRuleIdBigserial, table.Name+".id", `"id" must be a bigserial, got %v`, typ)
+		} else if !strings.HasPrefix(colDefaults[table.Name+".id"], "nextval(") {
+			add(DbLintRuleIdBigserial, table.Name+".id", `"id" must be a bigserial, got a bigint without a sequence`)
+		}
+
+		for _, name := range []string{"created_at", "updated_at"} {
+			if colTypes[table.Name+"."+name] == "" {
+				add(DbLintRuleTimed, table.Name, `missing column %q`, name)
+			}
+		}
+
+		if !table.HasTouchTrigger {
+			add(DbLintRuleTouchTrigger, table.Name, `missing "touch_updated_at" trigger`)
+		}
+	}
+
+	for _, col := range cols {
+		object := col.Table + "." + col.Name
+
+		switch col.Type {
+		case "timestamp without time zone":
+			add(DbLintRuleTimestamptz, object, `must be "timestamptz" rather than "timestamp"`)
+		case "integer", "smallint":
+			add(DbLintRuleBigint, object, `prefer "bigint" over %q`, col.Type)
+		}
+
+		if strings.HasPrefix(col.Type, "timestamp") && !strings.HasSuffix(col.Name, "_at") {
+			add(DbLintRuleTimeSuffix, object, `time columns must end with "_at"`)
+		}
+
+		if col.Type == "boolean" && !strings.HasPrefix(col.Name, "is_") {
+			add(DbLintRuleBoolPrefix, object, `boolean columns must start with "is_"`)
+		}
+	}
+
+	var constraints []struct {
+		Owner string `db:"owner"`
+		Name  string `db:"name"`
+	}
+	try.To(SqlQueryOrd(`
+		select
+			coalesce(c.relname, t.typname) as owner,
+			k.conname                      as name
+		from pg_constraint as k
+		join pg_namespace as n on n.oid = k.connamespace
+		left join pg_class as c on c.oid = k.conrelid
+		left join pg_type as t on t.oid = k.contypid
+		where n.nspname = 'tbl' and k.contype in ('c', 'u', 'x')
+		order by 1, 2
+	`).Query(ctx, conn, &constraints))
+
+	for _, con := range constraints {
+		if !strings.HasPrefix(con.Name, string(DbCodeConstraintPrefix)) {
+			add(DbLintRuleConstraintName, con.Owner+"."+con.Name, `constraint names must start with %q`, DbCodeConstraintPrefix)
+		}
+	}
+
+	var indexes []struct {
+		Table    string `db:"table_name"`
+		Name     string `db:"name"`
+		IsUnique bool   `db:"is_unique"`
+	}
+	try.To(SqlQueryOrd(`
+		select
+			c.relname     as table_name,
+			ic.relname    as name,
+			i.indisunique as is_unique
+		from pg_index as i
+		join pg_class as ic on ic.oid = i.indexrelid
+		join pg_class as c on c.oid = i.indrelid
+		join pg_namespace as n on n.oid = c.relnamespace
+		where
+			n.nspname = 'tbl'
+			and not i.indisprimary
+			and not exists(select from pg_constraint as k where k.conindid = i.indexrelid)
+		order by 1, 2
+	`).Query(ctx, conn, &indexes))
+
+	for _, index := range indexes {
+		object := index.Table + "." + index.Name
+		if index.IsUnique && !strings.HasPrefix(index.Name, string(DbCodeConstraintPrefix)) {
+			add(DbLintRuleConstraintName, object, `unique index names must start with %q`, DbCodeConstraintPrefix)
+		}
+		if !index.IsUnique && !uuidHexRegexp.MatchString(index.Name) {
+			add(DbLintRuleIndexName, object, `non-unique index names must be UUIDs without dashes`)
+		}
+	}
+
+	var fkeys []struct {
+		Table     string `db:"table_name"`
+		Name      string `db:"name"`
+		IsNotNull bool   `db:"is_not_null"`
+		OnUpdate  string `db:"on_update"`
+		OnDelete  string `db:"on_delete"`
+	}
+	try.To(SqlQueryOrd(`
+		select
+			c.relname              as table_name,
+			k.conname              as name,
+			bool_and(a.attnotnull) as is_not_null,
+			k.confupdtype::text    as on_update,
+			k.confdeltype::text    as on_delete
+		from pg_constraint as k
+		join pg_class as c on c.oid = k.conrelid
+		join pg_namespace as n on n.oid = c.relnamespace
+		join pg_attribute as a on a.attrelid = k.conrelid and a.attnum = any(k.conkey)
+		where n.nspname = 'tbl' and k.contype = 'f'
+		group by c.relname, k.conname, k.confupdtype, k.confdeltype
+		order by 1, 2
+	`).Query(ctx, conn, &fkeys))
+
+	for _, fkey := range fkeys {
+		object := fkey.Table + "." + fkey.Name
+
+		// See `pg_constraint.confupdtype`: "c" is cascade, "n" is set null.
+		if fkey.OnUpdate != "c" {
+			add(DbLintRuleForeignKey, object, `foreign keys must specify "on update cascade"`)
+		}
+		if fkey.IsNotNull && fkey.OnDelete != "c" {
+			add(DbLintRuleForeignKey, object, `not-null foreign keys must specify "on delete cascade"`)
+		}
+		if !fkey.IsNotNull && fkey.OnDelete != "c" && fkey.OnDelete != "n" {
+			add(DbLintRuleForeignKey, object, `nullable foreign keys must specify "on delete cascade" or "on delete set null"`)
+		}
+	}
+
+	violations, err := lintExplicitNull(DB_SCHEMA_TBL_PATH)
+	try.To(err)
+	out = append(out, violations...)
+
+	return out, nil
+}
+
+var uuidHexRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Irregular plurals that don't end with "s".
+var irregularPlurals = map[string]bool{
+	"children": true, "criteria": true, "data": true, "media": true, "people": true,
+}
+
+// Checks the last word of a snake_case identifier.
+func isPluralIdent(name string) bool {
+	word := name[strings.LastIndexByte(name, '_')+1:]
+	return strings.HasSuffix(word, "s") || irregularPlurals[word]
+}
+
+var (
+	createTableRegexp = regexp.MustCompile(`(?i)^create\s+table\s+([\w."]+)`)
+	columnLineRegexp  = regexp.MustCompile(`^([a-z_][a-z0-9_]*)\s+\S`)
+	nullRegexp        = regexp.MustCompile(`(?i)\bnull\b|\bprimary\s+key\b`)
+
+	// Clauses that follow the nullability in our column definitions, and may
+	// contain "null" themselves, as in "on delete set null" or "default null".
+	columnTailRegexp = regexp.MustCompile(`(?i)\b(?:default|references|check|generated)\b`)
+)
+
+/*
+Whether a column is explicitly "null" or "not null" is lost in the catalog, so
+we check the source, ignoring comments. Expects one column per line, as in the existing tables.
+Column lines are lines in a "create table" statement that start with an
+identifier other than a table constraint keyword. Only the part before
+"default", "references" and similar clauses is checked; see `columnHead`.
+*/
+func lintExplicitNull(filePath string) (out []DbLintViolation, err error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var table string
+	for _, line := range strings.Split(sqlStripComments(bytesToMutableString(content)), "\n") {
+		line = strings.TrimSpace(line)
+
+		match := createTableRegexp.FindStringSubmatch(line)
+		if match != nil {
+			table = strings.Trim(match[1], `"`)
+			continue
+		}
+		if table == "" {
+			continue
+		}
+		if strings.HasPrefix(line, ")") {
+			table = ""
+			continue
+		}
+
+		match = columnLineRegexp.FindStringSubmatch(line)
+		if match == nil || isSqlTableConstraintKeyword(match[1]) {
+			continue
+		}
+		if !nullRegexp.MatchString(columnHead(line)) {
+			out = append(out, DbLintViolation{
+				DbLintRuleExplicitNull, table + "." + match[1], `columns must explicitly specify "null" or "not null"`,
+			})
+		}
+	}
+	return out, nil
+}
+
+// Strips the clauses after the type and nullability of a column definition.
+func columnHead(line string) string {
+	loc := columnTailRegexp.FindStringIndex(line)
+	if loc != nil {
+		return line[:loc[0]]
+	}
+	return line
+}
+
+func isSqlTableConstraintKeyword(word string) bool {
+	switch word {
+	case "constraint", "check", "unique", "primary", "foreign", "exclude", "like":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Human-readable messages for DB codes (see `DbCode`), keyed by code, then by
+locale. Loaded from `Conf.DbMessagesPath` at startup. Example file content:
+
+	{
+	  "db.constraint.text_short_length": {
+	    "en": "Text must be at most 256 characters long."
+	  }
+	}
+
+Used by `writeErr` when rendering public DB errors. Codes without messages are
+rendered as-is.
+*/
+type DbMessages map[DbCode]map[string]string
+
+func initDbMessages() error {
+	if env.conf.DbMessagesPath == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(env.conf.DbMessagesPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var out DbMessages
+	err = jsonUnmarshal(content, &out)
+	if err != nil {
+		return errors.WithMessagef(err, `failed to decode DB messages from %q`, env.conf.DbMessagesPath)
+	}
+
+	env.dbMessages = out
+	return nil
+}
+
+/*
+Returns the message for the given code in the locale most preferred by the
+"accept-language" header, falling back on `Conf.DefaultLocale`. Also returns the
+chosen locale. Returns empty strings if there's no suitable message.
+*/
+func (self DbMessages) Get(header http.Header, code DbCode) (string, string) {
+	msgs := self[code]
+	if len(msgs) == 0 {
+		return "", ""
+	}
+
+	locales := make([]string, 0, len(msgs))
+	for locale := range msgs {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+
+	locale := strOr(negotiateLocale(header, locales), env.conf.DefaultLocale)
+	msg := msgs[locale]
+	if msg == "" {
+		return "", ""
+	}
+	return msg, locale
+}
+
+/*
+Chooses the offered locale most preferred by the "accept-language" header.
+Matches either the exact language tag, or its primary language: "en-US" matches
+"en". Returns "" when nothing matches.
+*/
+func negotiateLocale(header http.Header, offers []string) string {
+	var ranges []AcceptItem
+	for _, item := range parseAcceptHeader(header, "accept-language") {
+		if item.Value != "*" && item.Quality > 0 {
+			ranges = append(ranges, item)
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].Quality > ranges[j].Quality })
+
+	for _, rng := range ranges {
+		for _, offer := range offers {
+			if strings.EqualFold(rng.Value, offer) {
+				return offer
+			}
+		}
+		for _, offer := range offers {
+			if strings.EqualFold(primaryLanguage(rng.Value), primaryLanguage(offer)) {
+				return offer
+			}
+		}
+	}
+	return ""
+}
+
+func primaryLanguage(tag string) string {
+	if index := strings.IndexAny(tag, "-_"); index >= 0 {
+		return tag[:index]
+	}
+	return tag
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mitranim/try"
+	"github.com/pkg/errors"
+)
+
+/*
+Each migration is a separate file in `DB_MIGRATIONS_DIR`, applied in the order
+of file names. The migration name is the file name without the extension. See
+`migrations.pgsql` for the guidelines.
+*/
+type Migration struct {
+	Name     string
+	Path     string
+	Checksum string
+}
+
+type MigrationStatus string
+
+const (
+	MigrationStatusApplied  MigrationStatus = "applied"
+	MigrationStatusPending  MigrationStatus = "pending"
+	MigrationStatusModified MigrationStatus = "modified"
+)
+
+// Row in `starter.migrations`. Rows registered before we started storing
+// checksums have no checksum.
+type MigrationRow struct {
+	Name     string  `db:"name"`
+	Checksum *string `db:"checksum"`
+}
+
+type MigrationState struct {
+	Migration
+	Status MigrationStatus
+}
+
+/*
+Arbitrary key for `pg_advisory_xact_lock`, held for the duration of a DB update.
+Prevents concurrent updates, for example when several pods start at once. The
+lock is released when the transaction ends.
+*/
+const DB_MIGRATION_LOCK_KEY = 7_132_694_021
+
+func readMigrations() (out []Migration, err error) {
+	defer try.Rec(&err)
+
+	paths, err := filepath.Glob(filepath.Join(DB_MIGRATIONS_DIR, "*.pgsql"))
+	try.To(errors.WithStack(err))
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		try.To(errors.WithStack(err))
+
+		sum := sha256.Sum256(content)
+		out = append(out, Migration{
+			Name:     strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+			Path:     path,
+			Checksum: hex.EncodeToString(sum[:]),
+		})
+	}
+	return out, nil
+}
+
+// Returns nil if the migrations table doesn't exist yet.
+func dbMigrationRows(ctx Ctx, conn DbConn) ([]MigrationRow, error) {
+	var exists bool
+	err := SqlQueryOrd(`select to_regclass('starter.migrations') is not null`).Query(ctx, conn, &exists)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var out []MigrationRow
+	err = SqlQueryOrd(`select name, checksum from starter.migrations order by id`).Query(ctx, conn, &out)
+	return out, err
+}
+
+/*
+Compares migration files with registered migrations. Registered migrations
+without files are omitted: they're expected to be removed after being applied
+everywhere. Registered migrations without checksums are considered applied.
+*/
+func migrationStates(migrations []Migration, rows []MigrationRow) []MigrationState {
+	registered := map[string]MigrationRow{}
+	for _, row := range rows {
+		registered[row.Name] = row
+	}
+
+	out := make([]MigrationState, 0, len(migrations))
+	for _, mig := range migrations {
+		state := MigrationState{Migration: mig, Status: MigrationStatusPending}
+
+		row, ok := registered[mig.Name]
+		if ok {
+			state.Status = MigrationStatusApplied
+			if row.Checksum != nil && *row.Checksum != mig.Checksum {
+				state.Status = MigrationStatusModified
+			}
+		}
+
+		out = append(out, state)
+	}
+	return out
+}
+
+func dbMigrationStates(ctx Ctx, conn DbConn) ([]MigrationState, error) {
+	migrations, err := readMigrations()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := dbMigrationRows(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return migrationStates(migrations, rows), nil
+}
+
+/*
+Runs pending migrations and registers them in `starter.migrations`. Must run in
+a transaction, after `migrations.pgsql`, which creates the table.
+
+When the schema has just been created from `schema_tbl.pgsql`, it already
+reflects all migrations, so they're registered as completed without actually
+running them. This replaces `should_run_new_migration`, which served the same
+purpose when all migrations were in one file. Unlike that function, this
+doesn't rely on the table being empty, which would be wrong for a database
+whose schema predates all current migrations.
+
+Fails if an applied migration has been modified. Fills in missing checksums of
+applied migrations.
+*/
+func dbRunMigrations(ctx Ctx, conn DbTx, registerOnly bool) (err error) {
+	defer try.Rec(&err)
+
+	states, err := dbMigrationStates(ctx, conn)
+	try.To(err)
+
+	for _, state := range states {
+		switch state.Status {
+		case MigrationStatusModified:
+			panic(errors.Errorf(`migration %q was modified after being applied`, state.Name))
+
+		case MigrationStatusApplied:
+			try.To(SqlQueryOrd(
+				`update starter.migrations set checksum = $1 where name = $2 and checksum is null`,
+				state.Checksum, state.Name,
+			).Exec(ctx, conn))
+
+		case MigrationStatusPending:
+			if !registerOnly {
+				env.log.Info("running migration ", state.Name)
+				try.To(dbExec(ctx, conn, `set search_path to tbl`, nil))
+				try.To(dbExecFile(ctx, conn, state.Path))
+			}
+			try.To(SqlQueryOrd(
+				`insert into starter.migrations (name, checksum) values ($1, $2)`,
+				state.Name, state.Checksum,
+			).Exec(ctx, conn))
+		}
+	}
+	return nil
+}
+
+func dbLockMigrations(ctx Ctx, conn DbTx) error {
+	return SqlQueryOrd(`select pg_advisory_xact_lock($1)`, DB_MIGRATION_LOCK_KEY).Exec(ctx, conn)
+}
+
+var migrateStatusOpts struct {
+	Strict bool `long:"strict" description:"Exit with an error if any migrations are pending or modified"`
+}
+
+/*
+Lists migrations with their statuses. Usage:
+
+	go run ./go migrate status
+*/
+func cmdMigrateStatus() (err error) {
+	defer try.Rec(&err)
+
+	try.To(initDb())
+	defer func() { logError(closeDb()) }()
+
+	states, err := dbMigrationStates(ctxDefault(), env.db)
+	try.To(err)
+
+	if len(states) == 0 {
+		fmt.Println(`no migration files in`, DB_MIGRATIONS_DIR)
+		return nil
+	}
+
+	var unapplied int
+	for _, state := range states {
+		fmt.Printf("%-10v %v\n", state.Status, state.Name)
+		if state.Status != MigrationStatusApplied {
+			unapplied++
+		}
+	}
+
+	if migrateStatusOpts.Strict && unapplied > 0 {
+		return errors.Errorf(`found %v pending or modified migrations`, unapplied)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+/*
+Optional read replica, configured by `Conf.PostgresReplicaHost`. Read-only
+transactions created by `withDbTxOpts` are routed to the replica while it's
+healthy, and to the primary otherwise. See `dbForTx`.
+
+Replicas lag behind the primary. Code that must see its own recent writes, for
+example a read right after a redirect from a form submission, should set
+`DbTxOpts.Primary`.
+*/
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Opens the replica pool, if configured, and starts its health checks. Unlike
+// the primary, an unavailable replica doesn't prevent startup.
+func initDbReplica() error {
+	if env.conf.PostgresReplicaHost == "" {
+		return nil
+	}
+	if env.conf.PostgresReplicaCheckInterval <= 0 {
+		return errors.New(`POSTGRES_REPLICA_CHECK_INTERVAL must be positive`)
+	}
+
+	conn, err := openDb(env.conf.ReplicaConf())
+	if err != nil {
+		return err
+	}
+
+	env.dbReplica = conn
+	env.dbReplicaStop = make(chan struct{})
+
+	// Assumed to be up, which makes the first check log a failure.
+	atomic.StoreInt32(&env.dbReplicaUp, 1)
+	checkDbReplica(conn)
+	go runDbReplicaChecks(conn, env.dbReplicaStop)
+	return nil
+}
+
+/*
+Chooses the pool for a new transaction. Serializable transactions always go to
+the primary, because Postgres doesn't support them on standby servers.
+*/
+func dbForTx(opts DbTxOpts) *sql.DB {
+	if opts.ReadOnly && !opts.Primary &&
+		opts.Isolation != sql.LevelSerializable &&
+		env.dbReplica != nil &&
+		atomic.LoadInt32(&env.dbReplicaUp) != 0 {
+		return env.dbReplica
+	}
+	return env.db
+}
+
+func runDbReplicaChecks(conn *sql.DB, stop <-chan struct{}) {
+	ticker := time.NewTicker(env.conf.PostgresReplicaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			checkDbReplica(conn)
+		}
+	}
+}
+
+func checkDbReplica(conn *sql.DB) {
+	ctx, cancel := context.WithTimeout(context.Background(), env.conf.HealthCheckTimeout)
+	defer cancel()
+	setDbReplicaUp(dbReplicaHealth(ctx, conn))
+}
+
+/*
+Fails when the replica is unreachable, or when its replication lag exceeds
+`Conf.PostgresReplicaMaxLag`. A server that isn't in recovery is a primary,
+for example after a failover or in the local setup, and has no lag.
+
+The time since the last replayed transaction overstates the lag when the
+primary is idle, so a replica that has replayed everything it received is
+considered up to date.
+*/
+func dbReplicaHealth(ctx Ctx, conn DbConn) error {
+	var lagSeconds float64
+	err := SqlQueryOrd(`
+		select case
+			when not pg_is_in_recovery() then 0
+			when pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() then 0
+			else coalesce(extract(epoch from now() - pg_last_xact_replay_timestamp()), 0)
+		end::float8
+	`).Query(ctx, conn, &lagSeconds)
+	if err != nil {
+		return err
+	}
+
+	lag := time.Duration(lagSeconds * float64(time.Second))
+	maxLag := env.conf.PostgresReplicaMaxLag
+	if maxLag > 0 && lag > maxLag {
+		return errors.Errorf(`replication lag %v exceeds %v`, lag.Round(time.Millisecond), maxLag)
+	}
+	return nil
+}
+
+/*
+Also called when the replica is unreachable when starting a transaction, which
+takes it out of rotation until the next successful check. Logs only state
+changes.
+*/
+func setDbReplicaUp(err error) {
+	var up int32
+	if err == nil {
+		up = 1
+	}
+
+	prev := atomic.SwapInt32(&env.dbReplicaUp, up)
+	if prev == up {
+		return
+	}
+	if err == nil {
+		env.log.Info("DB replica is available")
+	} else {
+		env.log.Warnf("DB replica is unavailable, falling back on the primary: %v", err)
+	}
+}
+
+func closeDbReplica() error {
+	if env.dbReplica == nil {
+		return nil
+	}
+	close(env.dbReplicaStop)
+	return errors.Wrap(env.dbReplica.Close(), `failed to close DB replica connection pool`)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mitranim/try"
+)
+
+var dbUpdateOpts struct {
+	Rollback bool `short:"r" long:"rollback" description:"Apply everything, then roll back; verifies schema and migrations"`
+	DryRun   bool `short:"n" long:"dry-run" description:"Print what would be applied, without applying anything"`
+}
+
+/*
+Applies the schema and migrations. Usage:
+
+	go run ./go db_update
+	go run ./go db_update -r
+	go run ./go db_update -n
+*/
+func cmdDbUpdate() (err error) {
+	defer try.Rec(&err)
+
+	try.To(initDb())
+	defer func() { logError(closeDb()) }()
+
+	ctx := ctxDefault()
+
+	if dbUpdateOpts.DryRun {
+		plan, err := dbUpdatePlan(ctx, env.db)
+		try.To(err)
+		plan.Print()
+		return nil
+	}
+
+	if dbUpdateOpts.Rollback {
+		tx, err := beginTx(ctx, env.db)
+		try.To(err)
+		defer tx.Rollback()
+
+		try.To(dbUpdate(ctx, tx))
+		env.log.Info("DB update succeeded, rolling back")
+		return nil
+	}
+
+	try.To(withDbTx(ctx, dbUpdate))
+	env.log.Info("DB update succeeded")
+	return nil
+}
+
+/*
+Applies the schema (only if the DB doesn't have one yet), then migrations, then
+the ephemeral schema. Must run in a transaction. Holds an advisory lock until
+the transaction ends, to avoid racing other instances of the app.
+
+The SQL files must not contain psql meta-commands.
+*/
+func dbUpdate(ctx Ctx, conn DbTx) error {
+	err := dbLockMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	applySchema, err := dbHasNoTblSchema(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	/**
+	This is done to avoid accidentally referencing ephemeral entities in
+	persistent entities. `eph` is dropped and re-created after applying
+	migrations. Accidentally referencing `eph` in persistent entities, such as
+	tables, would cause them to be dropped when `eph` is refreshed.
+	*/
+	err = dbExec(ctx, conn, `drop schema if exists eph cascade`, nil)
+	if err != nil {
+		return err
+	}
+
+	if applySchema {
+		err = dbExecFile(ctx, conn, DB_SCHEMA_TBL_PATH)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dbExecFile(ctx, conn, DB_MIGRATIONS_PATH)
+	if err != nil {
+		return err
+	}
+
+	err = dbRunMigrations(ctx, conn, applySchema)
+	if err != nil {
+		return err
+	}
+
+	err = dbExecFile(ctx, conn, DB_SCHEMA_EPH_PATH)
+	if err != nil {
+		return err
+	}
+
+	// The SQL files change the search path, which would otherwise persist for
+	// this connection after committing.
+	return dbExec(ctx, conn, `reset search_path`, nil)
+}
+
+func dbHasNoTblSchema(ctx Ctx, conn DbConn) (bool, error) {
+	var out bool
+	err := SqlQueryOrd(`
+		select not exists(
+			select from information_schema.schemata where schema_name = 'tbl'
+		)
+	`).Query(ctx, conn, &out)
+	return out, err
+}
+
+// Describes what `dbUpdate` would do, without doing it. See `dbUpdatePlan`.
+type DbUpdatePlan struct {
+	ApplySchema  bool
+	RegisterOnly bool
+	Migrations   []MigrationState
+}
+
+func (self DbUpdatePlan) Print() {
+	if self.ApplySchema {
+		fmt.Printf("schema \"tbl\" is missing and will be created from %v\n", DB_SCHEMA_TBL_PATH)
+	}
+
+	var pending, modified []string
+	for _, state := range self.Migrations {
+		switch state.Status {
+		case MigrationStatusPending:
+			pending = append(pending, state.Name)
+		case MigrationStatusModified:
+			modified = append(modified, state.Name)
+		}
+	}
+
+	if len(modified) > 0 {
+		printList(`migrations modified after being applied (the update will fail):`, modified)
+	}
+
+	if len(pending) == 0 {
+		fmt.Println(`no pending migrations`)
+	} else if self.RegisterOnly {
+		printList(`migrations to register as completed without running:`, pending)
+	} else {
+		printList(`migrations to run:`, pending)
+	}
+
+	fmt.Printf("ephemeral schema will be re-created from %v\n", DB_SCHEMA_EPH_PATH)
+}
+
+func printList(title string, items []string) {
+	fmt.Println(title)
+	for _, item := range items {
+		fmt.Println(PRETTY_PRINT_INDENT + item)
+	}
+}
+
+func dbUpdatePlan(ctx Ctx, conn DbConn) (plan DbUpdatePlan, err error) {
+	defer try.Rec(&err)
+
+	plan.ApplySchema, err = dbHasNoTblSchema(ctx, conn)
+	try.To(err)
+
+	// See `dbRunMigrations`.
+	plan.RegisterOnly = plan.ApplySchema
+
+	plan.Migrations, err = dbMigrationStates(ctx, conn)
+	try.To(err)
+	return plan, nil
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"regexp"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/jessevdk/go-flags"
 	"github.com/mitranim/goh"
 	"github.com/mitranim/try"
 	"go.uber.org/zap"
@@ -21,17 +26,27 @@ Defined as an anonymous type because this should be ALWAYS referenced as a
 global and never passed around.
 */
 var env = func() (env struct {
-	conf           Conf               // conf.go
-	log            *zap.SugaredLogger // utils_log.go
-	db             *sql.DB            // db.go
-	serverListener net.Listener       // server.go
-	server         *http.Server       // server.go
-	rand           *rand.Rand         // utils_text.go
-	fileServer     http.Handler       // server.go
+	conf            Conf               // conf.go
+	log             *zap.SugaredLogger // utils_log.go
+	db              *sql.DB            // db.go
+	dbReplica       *sql.DB            // db_replica.go
+	dbReplicaUp     int32              // db_replica.go; must be accessed atomically
+	dbReplicaStop   chan struct{}      // db_replica.go
+	serverListener  net.Listener       // server.go
+	server          *http.Server       // server.go
+	serverCtx       Ctx                // server.go
+	serverCancel    context.CancelFunc // server.go
+	serverDraining  int32              // server.go; must be accessed atomically
+	rand            *rand.Rand         // utils_text.go; safe for concurrent use, except `.Read`
+	staticImmutable *regexp.Regexp     // server_static.go
+	dbMessages      DbMessages         // db_messages.go
+	migrations      []Migration        // db_migrations.go; read by `initServer`
+	metrics         *Metrics           // metrics.go
 }) {
 	try.To(env.conf.Init())
-	env.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	env.rand = rand.New(NewLockedRandSource(time.Now().UnixNano()))
 	env.log = env.conf.TryLogger()
+	env.metrics = new(Metrics)
 	return
 }()
 
@@ -46,6 +61,61 @@ func init() {
 	spew.Config.ContinueOnMethod = true
 }
 
+/*
+Without a subcommand, runs the server. Exits with status 0 after a graceful
+shutdown, and with status 1 if the server failed or couldn't drain in-flight
+requests in time. Subcommands also exit with status 1 on failure. Usage:
+
+	go run ./go
+	go run ./go -h
+	go run ./go db_update -r
+	go run ./go migrate status
+*/
 func main() {
-	try.To(startServer())
+	parser := flags.NewNamedParser("starter", flags.HelpFlag|flags.PassDoubleDash)
+	parser.SubcommandsOptional = true
+
+	addCmd(parser.Command, "server", "Run the HTTP server (default)", cmd{startServer}, nil)
+	addCmd(parser.Command, "db_update", "Apply schema and migrations", cmd{cmdDbUpdate}, &dbUpdateOpts)
+
+	migrate, err := parser.AddCommand("migrate", "Inspect migrations", "", &struct{}{})
+	try.To(err)
+	addCmd(migrate, "status", "List applied, pending and modified migrations", cmd{cmdMigrateStatus}, &migrateStatusOpts)
+
+	addCmd(parser.Command, "db_drift", "Verify that migrations produce the same schema as schema_tbl.pgsql", cmd{cmdDbDrift}, nil)
+	addCmd(parser.Command, "db_lint", "Check the schema against the guidelines in schema_tbl.pgsql", cmd{cmdDbLint}, nil)
+
+	args, err := parser.Parse()
+	if err == nil && parser.Active == nil {
+		if len(args) > 0 {
+			err = &flags.Error{Type: flags.ErrUnknownCommand, Message: fmt.Sprintf(`unknown command %q`, args[0])}
+		} else {
+			err = startServer()
+		}
+	}
+	if err == nil {
+		return
+	}
+
+	flagsErr, ok := err.(*flags.Error)
+	if ok && flagsErr.Type == flags.ErrHelp {
+		fmt.Println(flagsErr)
+		return
+	}
+	if ok {
+		fmt.Fprintln(os.Stderr, flagsErr)
+	} else {
+		logError(err)
+	}
+	os.Exit(1)
+}
+
+func addCmd(parent *flags.Command, name string, desc string, val cmd, opts interface{}) {
+	command, err := parent.AddCommand(name, desc, "", &val)
+	try.To(err)
+
+	if opts != nil {
+		_, err = command.AddGroup("Options", "", opts)
+		try.To(err)
+	}
 }
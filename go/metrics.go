@@ -0,0 +1,356 @@
+package main
+
+/*
+Application metrics, served at "/metrics" in the Prometheus text exposition
+format: https://prometheus.io/docs/instrumenting/exposition_formats/.
+
+Our needs are modest (a few counters, gauges and histograms), so we implement
+the format directly rather than depending on the Prometheus client library.
+*/
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mitranim/goh"
+	"github.com/pkg/errors"
+)
+
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Upper bounds of latency histogram buckets, in seconds. Same as the defaults
+// of the Prometheus client library.
+var METRICS_DURATION_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+/*
+Should be used via `env.metrics`. Safe for concurrent use. Maps are keyed by
+label values, and lazily initialized.
+*/
+type Metrics struct {
+	httpInFlight int64 // Must be accessed atomically.
+
+	lock          sync.Mutex
+	httpRequests  map[MetricsHttpKey]uint64
+	httpDurations map[MetricsRouteKey]*MetricsHistogram
+	errors        map[MetricsErrKey]uint64
+	dbTxCommits   uint64
+	dbTxRollbacks uint64
+	dbTxRetries   map[string]uint64
+}
+
+type MetricsHttpKey struct {
+	Method string
+	Route  string
+	Status int
+}
+
+type MetricsRouteKey struct {
+	Method string
+	Route  string
+}
+
+type MetricsErrKey struct {
+	DbCode DbCode
+	Status int
+}
+
+// Cumulative counts are computed when writing.
+type MetricsHistogram struct {
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+func (self *MetricsHistogram) Observe(val float64) {
+	if self.Counts == nil {
+		self.Counts = make([]uint64, len(METRICS_DURATION_BUCKETS))
+	}
+	for i, bound := range METRICS_DURATION_BUCKETS {
+		if val <= bound {
+			self.Counts[i]++
+			break
+		}
+	}
+	self.Count++
+	self.Sum += val
+}
+
+func (self *Metrics) HttpStart() {
+	atomic.AddInt64(&self.httpInFlight, 1)
+}
+
+func (self *Metrics) HttpEnd(method string, route string, status int, duration time.Duration) {
+	atomic.AddInt64(&self.httpInFlight, -1)
+	method = metricsMethod(method)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.httpRequests == nil {
+		self.httpRequests = map[MetricsHttpKey]uint64{}
+	}
+	self.httpRequests[MetricsHttpKey{method, route, status}]++
+
+	if self.httpDurations == nil {
+		self.httpDurations = map[MetricsRouteKey]*MetricsHistogram{}
+	}
+	key := MetricsRouteKey{method, route}
+	hist := self.httpDurations[key]
+	if hist == nil {
+		hist = new(MetricsHistogram)
+		self.httpDurations[key] = hist
+	}
+	hist.Observe(duration.Seconds())
+}
+
+// Counts error responses sent to clients. See `writeErr`.
+func (self *Metrics) Err(code DbCode, status int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.errors == nil {
+		self.errors = map[MetricsErrKey]uint64{}
+	}
+	self.errors[MetricsErrKey{code, status}]++
+}
+
+// Counts transactions finished by `withDbTx`.
+func (self *Metrics) DbTx(committed bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if committed {
+		self.dbTxCommits++
+	} else {
+		self.dbTxRollbacks++
+	}
+}
+
+// Counts transactions retried by `withDbTxOpts`, by Postgres error code.
+func (self *Metrics) DbTxRetry(code string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.dbTxRetries == nil {
+		self.dbTxRetries = map[string]uint64{}
+	}
+	self.dbTxRetries[code]++
+}
+
+/*
+Writes all metrics in the text exposition format. Series are sorted, making the
+output deterministic.
+*/
+func (self *Metrics) WriteTo(buf *bytes.Buffer) {
+	metricsHeader(buf, "http_requests_in_flight", "gauge", "HTTP requests currently being served.")
+	metricsLine(buf, "http_requests_in_flight", "", float64(atomic.LoadInt64(&self.httpInFlight)))
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	metricsHeader(buf, "http_requests_total", "counter", "HTTP requests by method, route pattern and status.")
+	httpKeys := make([]MetricsHttpKey, 0, len(self.httpRequests))
+	for key := range self.httpRequests {
+		httpKeys = append(httpKeys, key)
+	}
+	sort.Slice(httpKeys, func(i, j int) bool {
+		left, right := httpKeys[i], httpKeys[j]
+		if left.Route != right.Route {
+			return left.Route < right.Route
+		}
+		if left.Method != right.Method {
+			return left.Method < right.Method
+		}
+		return left.Status < right.Status
+	})
+	for _, key := range httpKeys {
+		labels := metricsLabels("method", key.Method, "route", key.Route, "status", strconv.Itoa(key.Status))
+		metricsLine(buf, "http_requests_total", labels, float64(self.httpRequests[key]))
+	}
+
+	metricsHeader(buf, "http_request_duration_seconds", "histogram", "HTTP request latency by method and route pattern.")
+	routeKeys := make([]MetricsRouteKey, 0, len(self.httpDurations))
+	for key := range self.httpDurations {
+		routeKeys = append(routeKeys, key)
+	}
+	sort.Slice(routeKeys, func(i, j int) bool {
+		left, right := routeKeys[i], routeKeys[j]
+		if left.Route != right.Route {
+			return left.Route < right.Route
+		}
+		return left.Method < right.Method
+	})
+	for _, key := range routeKeys {
+		hist := self.httpDurations[key]
+		var cumulative uint64
+		for i, bound := range METRICS_DURATION_BUCKETS {
+			cumulative += hist.Counts[i]
+			labels := metricsLabels("method", key.Method, "route", key.Route, "le", metricsFloat(bound))
+			metricsLine(buf, "http_request_duration_seconds_bucket", labels, float64(cumulative))
+		}
+		labels := metricsLabels("method", key.Method, "route", key.Route, "le", "+Inf")
+		metricsLine(buf, "http_request_duration_seconds_bucket", labels, float64(hist.Count))
+
+		labels = metricsLabels("method", key.Method, "route", key.Route)
+		metricsLine(buf, "http_request_duration_seconds_sum", labels, hist.Sum)
+		metricsLine(buf, "http_request_duration_seconds_count", labels, float64(hist.Count))
+	}
+
+	metricsHeader(buf, "http_errors_total", "counter", "Error responses by DB code and status.")
+	errKeys := make([]MetricsErrKey, 0, len(self.errors))
+	for key := range self.errors {
+		errKeys = append(errKeys, key)
+	}
+	sort.Slice(errKeys, func(i, j int) bool {
+		left, right := errKeys[i], errKeys[j]
+		if left.DbCode != right.DbCode {
+			return left.DbCode < right.DbCode
+		}
+		return left.Status < right.Status
+	})
+	for _, key := range errKeys {
+		labels := metricsLabels("db_code", string(key.DbCode), "status", strconv.Itoa(key.Status))
+		metricsLine(buf, "http_errors_total", labels, float64(self.errors[key]))
+	}
+
+	metricsHeader(buf, "db_tx_total", "counter", "DB transactions started by the app, by outcome.")
+	metricsLine(buf, "db_tx_total", metricsLabels("outcome", "commit"), float64(self.dbTxCommits))
+	metricsLine(buf, "db_tx_total", metricsLabels("outcome", "rollback"), float64(self.dbTxRollbacks))
+
+	metricsHeader(buf, "db_tx_retries_total", "counter", "DB transactions retried after conflicts, by Postgres error code.")
+	codes := make([]string, 0, len(self.dbTxRetries))
+	for code := range self.dbTxRetries {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		metricsLine(buf, "db_tx_retries_total", metricsLabels("code", code), float64(self.dbTxRetries[code]))
+	}
+}
+
+/*
+Writes gauges of the DB connection pool. Stats are read when serving metrics,
+rather than collected continuously.
+*/
+func writeDbPoolMetrics(buf *bytes.Buffer) {
+	if env.db == nil {
+		return
+	}
+	stats := env.db.Stats()
+
+	metricsGauge(buf, "db_pool_max_open_connections", "Maximum number of open DB connections.", float64(stats.MaxOpenConnections))
+	metricsGauge(buf, "db_pool_open_connections", "Established DB connections, both in use and idle.", float64(stats.OpenConnections))
+	metricsGauge(buf, "db_pool_in_use_connections", "DB connections currently in use.", float64(stats.InUse))
+	metricsGauge(buf, "db_pool_idle_connections", "Idle DB connections.", float64(stats.Idle))
+
+	metricsHeader(buf, "db_pool_wait_total", "counter", "Total number of waits for a DB connection.")
+	metricsLine(buf, "db_pool_wait_total", "", float64(stats.WaitCount))
+	metricsHeader(buf, "db_pool_wait_seconds_total", "counter", "Total time spent waiting for a DB connection.")
+	metricsLine(buf, "db_pool_wait_seconds_total", "", stats.WaitDuration.Seconds())
+	metricsHeader(buf, "db_pool_closed_total", "counter", "DB connections closed by the pool, by reason.")
+	metricsLine(buf, "db_pool_closed_total", metricsLabels("reason", "max_idle"), float64(stats.MaxIdleClosed))
+	metricsLine(buf, "db_pool_closed_total", metricsLabels("reason", "max_idle_time"), float64(stats.MaxIdleTimeClosed))
+	metricsLine(buf, "db_pool_closed_total", metricsLabels("reason", "max_lifetime"), float64(stats.MaxLifetimeClosed))
+
+	if env.dbReplica != nil {
+		metricsGauge(buf, "db_replica_up", "Whether the DB read replica passes health checks.", float64(atomic.LoadInt32(&env.dbReplicaUp)))
+	}
+}
+
+/*
+Metrics reveal routes, traffic and error rates, and are served on the public
+port, so they require `Conf.MetricsToken`.
+*/
+func serveMetrics(rew Rew, req *Req) {
+	err := authMetrics(req)
+	if err != nil {
+		writeErr(rew, req, false, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	env.metrics.WriteTo(&buf)
+	writeDbPoolMetrics(&buf)
+
+	goh.Bytes{
+		Header: httpHead("content-type", METRICS_CONTENT_TYPE),
+		Body:   buf.Bytes(),
+	}.ServeHTTP(rew, req)
+}
+
+func authMetrics(req *Req) error {
+	token := env.conf.MetricsToken
+	if token == "" {
+		return ErrPubNotFound(errors.New(`metrics are disabled`))
+	}
+
+	// The scheme is case-insensitive. Constant-time comparison doesn't leak the
+	// token via response timing.
+	head := req.Header.Get("authorization")
+	const scheme = "bearer "
+	if len(head) < len(scheme) || !strings.EqualFold(head[:len(scheme)], scheme) ||
+		subtle.ConstantTimeCompare([]byte(head[len(scheme):]), []byte(token)) != 1 {
+		return ErrPubUnauthenticated(errors.New(`invalid metrics token`))
+	}
+	return nil
+}
+
+func metricsHeader(buf *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(buf, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func metricsGauge(buf *bytes.Buffer, name string, help string, val float64) {
+	metricsHeader(buf, name, "gauge", help)
+	metricsLine(buf, name, "", val)
+}
+
+func metricsLine(buf *bytes.Buffer, name string, labels string, val float64) {
+	buf.WriteString(name)
+	buf.WriteString(labels)
+	buf.WriteByte(' ')
+	buf.WriteString(metricsFloat(val))
+	buf.WriteByte('\n')
+}
+
+// Takes alternating label names and values.
+func metricsLabels(pairs ...string) string {
+	var buf strings.Builder
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(pairs[i])
+		buf.WriteString(`="`)
+		buf.WriteString(metricsLabelReplacer.Replace(pairs[i+1]))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+var metricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricsFloat(val float64) string {
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+/*
+Clients may send arbitrary methods. Collapsing unknown ones keeps the number of
+series bounded.
+*/
+func metricsMethod(method string) string {
+	switch method {
+	case GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS:
+		return method
+	default:
+		return "OTHER"
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/mitranim/try"
 	"github.com/pkg/errors"
@@ -25,6 +32,12 @@ func initServer() (err error) {
 	defer try.Rec(&err)
 
 	try.To(initDb())
+	try.To(initDbMessages())
+	try.To(validateCorsOrigins())
+
+	// Checked by `apiHealthReady`. Files don't change while the server runs.
+	env.migrations, err = readMigrations()
+	try.To(err)
 
 	/**
 	Manually creating a listener allows us to find the auto-assigned port if
@@ -33,9 +46,23 @@ func initServer() (err error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", env.conf.ServerPort))
 	try.To(err)
 
+	/**
+	All request contexts are derived from this one. Canceling it after the
+	shutdown deadline aborts the remaining requests and their DB transactions.
+	*/
+	env.serverCtx, env.serverCancel = context.WithCancel(context.Background())
+
 	env.serverListener = listener
-	env.server = &http.Server{Handler: http.HandlerFunc(handleRequest)}
-	env.fileServer = http.FileServer(http.Dir(env.conf.PublicDir))
+	env.server = &http.Server{
+		Handler:           http.HandlerFunc(handleRequest),
+		BaseContext:       func(net.Listener) Ctx { return env.serverCtx },
+		ReadHeaderTimeout: env.conf.ServerReadHeaderTimeout,
+		ReadTimeout:       env.conf.ServerReadTimeout,
+		WriteTimeout:      env.conf.ServerWriteTimeout,
+		IdleTimeout:       env.conf.ServerIdleTimeout,
+	}
+	env.staticImmutable, err = regexp.Compile(env.conf.StaticImmutablePattern)
+	try.To(errors.Wrap(err, `invalid STATIC_IMMUTABLE_PATTERN`))
 
 	return nil
 }
@@ -43,11 +70,76 @@ func initServer() (err error) {
 /*
 Since the TCP listener is already initialized, this should be instant, which
 means tests don't need to poll the server for readiness.
+
+Runs until the listener fails, or until the process receives SIGINT or SIGTERM,
+in which case the server is gracefully stopped via `stopServer`.
 */
 func runServer() error {
 	listener := env.serverListener
 	port := listener.Addr().(*net.TCPAddr).Port
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- env.server.Serve(listener) }()
+
 	env.log.Info("listening on http://localhost:", port)
-	err := env.server.Serve(listener)
-	return errors.WithStack(err)
+
+	select {
+	case err := <-errChan:
+		return errors.WithStack(err)
+	case sig := <-sigChan:
+		env.log.Info("received ", sig, ", shutting down")
+	}
+
+	return stopServer(sigChan)
+}
+
+/*
+Reports draining via `apiHealthReady` for `Conf.ServerDrainDelay`, then stops
+accepting new connections and waits for in-flight requests to finish, up to
+`Conf.ServerShutdownTimeout`. After the deadline, cancels the contexts of the
+remaining requests, which aborts their DB transactions, and forcibly closes
+their connections. Closes the DB pool at the end.
+
+A second signal skips the drain delay, for impatient humans.
+
+Returns an error if the requests could not be drained in time, allowing the
+process to exit with a non-zero status.
+*/
+func stopServer(sigChan <-chan os.Signal) error {
+	atomic.StoreInt32(&env.serverDraining, 1)
+	if env.conf.ServerDrainDelay > 0 {
+		env.log.Info("draining for ", env.conf.ServerDrainDelay)
+		select {
+		case <-time.After(env.conf.ServerDrainDelay):
+		case sig := <-sigChan:
+			env.log.Info("received ", sig, ", skipping drain")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), env.conf.ServerShutdownTimeout)
+	defer cancel()
+
+	err := env.server.Shutdown(ctx)
+	env.serverCancel()
+
+	if err != nil {
+		_ = env.server.Close()
+		err = errors.Wrapf(err, `failed to drain in-flight requests within %v`, env.conf.ServerShutdownTimeout)
+	}
+
+	dbErr := closeDb()
+	if err != nil {
+		logError(dbErr)
+		return err
+	}
+	if dbErr != nil {
+		return dbErr
+	}
+
+	env.log.Info("server stopped")
+	return nil
 }
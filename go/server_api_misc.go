@@ -1,3 +1,113 @@
 package main
 
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Liveness check: the process is up and serving requests. Deliberately doesn't
+check dependencies; restarting the app doesn't fix a broken DB.
+*/
 func apiHealthCheck(Rew, *Req) {}
+
+type HealthStatus string
+
+const (
+	HealthStatusOk   HealthStatus = "ok"
+	HealthStatusFail HealthStatus = "fail"
+)
+
+type HealthRes struct {
+	Status HealthStatus           `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Status HealthStatus `json:"status"`
+	Error  string       `json:"error,omitempty"`
+}
+
+/*
+Readiness check: the app can serve traffic. Responds with 503 while draining
+on shutdown (see `stopServer`), when the DB doesn't respond within
+`Conf.HealthCheckTimeout`, or when the DB has pending or modified migrations.
+The body has a breakdown per check.
+
+Error details are logged rather than exposed, since they may mention hosts and
+credentials.
+*/
+func apiHealthReady(rew Rew, req *Req) {
+	ctx, cancel := context.WithTimeout(req.Context(), env.conf.HealthCheckTimeout)
+	defer cancel()
+
+	res := HealthRes{Status: HealthStatusOk, Checks: map[string]HealthCheck{}}
+	check := func(name string, err error, msg string) {
+		if err == nil {
+			res.Checks[name] = HealthCheck{Status: HealthStatusOk}
+			return
+		}
+		logErrorCtx(ctx, errors.WithMessagef(err, `readiness check %q failed`, name))
+		res.Status = HealthStatusFail
+		res.Checks[name] = HealthCheck{Status: HealthStatusFail, Error: msg}
+	}
+
+	// Expected during shutdown, not worth logging.
+	res.Checks["server"] = HealthCheck{Status: HealthStatusOk}
+	if atomic.LoadInt32(&env.serverDraining) != 0 {
+		res.Status = HealthStatusFail
+		res.Checks["server"] = HealthCheck{Status: HealthStatusFail, Error: "draining"}
+	}
+
+	check("db", healthCheckDb(ctx), "DB is unavailable")
+
+	pending, err := healthCheckMigrations(ctx)
+	msg := "failed to check migrations"
+	if err == nil && pending > 0 {
+		msg = fmt.Sprintf("%v migrations are pending or modified", pending)
+		err = errors.New(msg)
+	}
+	check("migrations", err, msg)
+
+	status := http.StatusOK
+	if res.Status != HealthStatusOk {
+		status = http.StatusServiceUnavailable
+	}
+	out, err := resJsonWith(status, res)
+	writeResOrErr(rew, req, out, err)
+}
+
+func healthCheckDb(ctx Ctx) error {
+	if env.db == nil {
+		return errors.New(`DB is not initialized`)
+	}
+	return errors.WithStack(env.db.PingContext(ctx))
+}
+
+/*
+Returns the count of migrations that are not applied as-is. Compares the DB with
+migration files read at startup, which avoids reading and hashing the files on
+every probe.
+*/
+func healthCheckMigrations(ctx Ctx) (int, error) {
+	if env.db == nil {
+		return 0, errors.New(`DB is not initialized`)
+	}
+
+	rows, err := dbMigrationRows(ctx, env.db)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, state := range migrationStates(env.migrations, rows) {
+		if state.Status != MigrationStatusApplied {
+			count++
+		}
+	}
+	return count, nil
+}
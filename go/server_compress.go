@@ -0,0 +1,277 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Supported content codings, in order of preference. Note that the HTTP "deflate"
+coding is actually the zlib format, not raw deflate.
+*/
+const (
+	ENCODING_GZIP    = "gzip"
+	ENCODING_DEFLATE = "deflate"
+)
+
+// Compressors are expensive to allocate, so we reuse them.
+var (
+	gzipWriterPool = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibWriterPool = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+/*
+Short for "compressing response writer". Compresses responses with gzip or
+deflate, negotiated via the "accept-encoding" header, when their content type
+matches `Conf.CompressTypes`, and their size is at least
+`Conf.CompressMinSize`. Should be created by `handleRequest`, and must be
+closed after the response is written.
+
+Until the size threshold is reached, the headers and the body are buffered.
+This allows `writeErr` to discard a partially written response and send an
+error instead (see `.Discard`). After that, the response is committed: writing
+the error into the compressed stream would corrupt it.
+*/
+type CompressRew struct {
+	http.ResponseWriter
+	Req *Req
+
+	status  int
+	buf     []byte
+	decided bool
+	writer  io.WriteCloser
+}
+
+func (self *CompressRew) WriteHeader(status int) {
+	if self.decided {
+		self.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if self.status == 0 {
+		self.status = status
+	}
+	if !httpStatusAllowsBody(status) {
+		self.decide(false)
+	}
+}
+
+func (self *CompressRew) Write(chunk []byte) (int, error) {
+	if !self.decided {
+		if self.compressibleType() == "" {
+			self.decide(false)
+		} else {
+			self.buf = append(self.buf, chunk...)
+			if len(self.buf) >= env.conf.CompressMinSize {
+				self.decide(true)
+			}
+			return len(chunk), nil
+		}
+	}
+
+	if self.writer != nil {
+		return self.writer.Write(chunk)
+	}
+	return self.ResponseWriter.Write(chunk)
+}
+
+/*
+Streaming responses are compressed regardless of size, since we can't wait for
+the threshold.
+*/
+func (self *CompressRew) Flush() {
+	if !self.decided {
+		self.decide(true)
+	}
+
+	flusher, _ := self.writer.(interface{ Flush() error })
+	if flusher != nil {
+		_ = flusher.Flush()
+	}
+
+	rewFlusher, _ := self.ResponseWriter.(http.Flusher)
+	if rewFlusher != nil {
+		rewFlusher.Flush()
+	}
+}
+
+// Lets wrapping writers and middleware reach the underlying writer.
+func (self *CompressRew) Unwrap() http.ResponseWriter { return self.ResponseWriter }
+
+/*
+Headers that describe the body rather than the resource or the exchange.
+Removed by `CompressRew.Discard`.
+*/
+var REPRESENTATION_HEADERS = []string{
+	"accept-ranges",
+	"content-disposition",
+	"content-encoding",
+	"content-language",
+	"content-length",
+	"content-range",
+	"content-type",
+	"etag",
+	"last-modified",
+}
+
+/*
+Discards the buffered response, if nothing has been sent to the client yet.
+Returns true on success. Also removes headers describing the discarded body,
+including "vary: accept-encoding", which is added again if the replacement is
+compressible. Other "vary" values, such as "origin", still apply.
+*/
+func (self *CompressRew) Discard() bool {
+	if self.decided {
+		return false
+	}
+
+	self.status = 0
+	self.buf = self.buf[:0]
+
+	header := self.Header()
+	for _, key := range REPRESENTATION_HEADERS {
+		header.Del(key)
+	}
+	delVary(header, "accept-encoding")
+	return true
+}
+
+// Sends the remainder of the response. Must be called once.
+func (self *CompressRew) Close() error {
+	if !self.decided {
+		self.decide(len(self.buf) >= env.conf.CompressMinSize)
+	}
+
+	writer := self.writer
+	if writer == nil {
+		return nil
+	}
+	self.writer = nil
+
+	err := writer.Close()
+	switch writer := writer.(type) {
+	case *gzip.Writer:
+		gzipWriterPool.Put(writer)
+	case *zlib.Writer:
+		zlibWriterPool.Put(writer)
+	}
+	return err
+}
+
+func closeCompressRew(req *Req, rew *CompressRew) {
+	err := rew.Close()
+	if err != nil {
+		maybeLogError(req.Context(), errors.Wrap(err, `failed to finish compressed response`))
+	}
+}
+
+/*
+Chooses between compressing and sending the response as-is, sends the headers
+and the buffered body. When `sized` is false, the response is not compressed.
+*/
+func (self *CompressRew) decide(sized bool) {
+	self.decided = true
+	header := self.Header()
+
+	if self.compressibleType() != "" {
+		addVary(header, "accept-encoding")
+
+		encoding := self.negotiateEncoding()
+		if sized && encoding != "" {
+			header.Set("content-encoding", encoding)
+			header.Del("content-length")
+			weakenEtag(header)
+			self.writer = newCompressor(encoding, self.ResponseWriter)
+		}
+	}
+
+	if self.status != 0 {
+		self.ResponseWriter.WriteHeader(self.status)
+	}
+
+	buf := self.buf
+	self.buf = nil
+	if len(buf) > 0 {
+		if self.writer != nil {
+			_, _ = self.writer.Write(buf)
+		} else {
+			_, _ = self.ResponseWriter.Write(buf)
+		}
+	}
+}
+
+/*
+Returns the media type if the response may be compressed, judging by the
+request, the status and the headers, or "".
+*/
+func (self *CompressRew) compressibleType() string {
+	if self.Req.Method == HEAD {
+		return ""
+	}
+
+	status := self.status
+	if status == http.StatusPartialContent || !httpStatusAllowsBody(status) {
+		return ""
+	}
+
+	header := self.Header()
+	if header.Get("content-encoding") != "" ||
+		strings.Contains(strings.ToLower(header.Get("cache-control")), "no-transform") {
+		return ""
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("content-type"))
+	if err != nil {
+		return ""
+	}
+	for _, pattern := range env.conf.CompressTypes {
+		ok, _ := path.Match(pattern, mediaType)
+		if ok {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+func (self *CompressRew) negotiateEncoding() string {
+	for _, encoding := range []string{ENCODING_GZIP, ENCODING_DEFLATE} {
+		if acceptsEncoding(self.Req.Header, encoding) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+func newCompressor(encoding string, out io.Writer) io.WriteCloser {
+	switch encoding {
+	case ENCODING_GZIP:
+		writer := gzipWriterPool.Get().(*gzip.Writer)
+		writer.Reset(out)
+		return writer
+	case ENCODING_DEFLATE:
+		writer := zlibWriterPool.Get().(*zlib.Writer)
+		writer.Reset(out)
+		return writer
+	default:
+		panic(errors.Errorf(`unsupported encoding %q`, encoding))
+	}
+}
+
+/*
+A compressed response is a different representation of the resource, so its
+strong ETag would be wrong. Weak ETags are still matched by "If-None-Match",
+which keeps revalidation working.
+*/
+func weakenEtag(header http.Header) {
+	etag := header.Get("etag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("etag", "W/"+etag)
+	}
+}
@@ -1,25 +1,76 @@
 package main
 
-import "github.com/mitranim/rout"
+import (
+	"net/http"
+	"time"
 
-func handleRequest(rew Rew, req *Req) {
+	"github.com/mitranim/rout"
+	"github.com/pkg/errors"
+)
+
+func handleRequest(rew Rew, req *Req) { handleRequestWith(rew, req, routes) }
+
+// Separate from `handleRequest` for testing with other routes.
+func handleRequestWith(rew Rew, req *Req, routes func(rout.R)) {
+	start := time.Now()
+	crew := &CompressRew{ResponseWriter: rew, Req: req}
+	rec := &RecRew{ResponseWriter: crew}
+	rew = rec
+
+	req = reqWithReqId(rew, req)
+	req = reqWithRecRew(req, rec)
 	req = reqWithReqCtx(req)
-	preventCaching(rew.Header())
-	allowCors(rew.Header())
+	env.metrics.HttpStart()
+	defer finishRequest(req, rec, start)
+	defer closeCompressRew(req, crew)
+	defer recWriteErr(rew, req)
+
+	limitReqBody(rew, req)
+	corsAllowed := allowCors(rew.Header(), req)
 
 	if req.Method == OPTIONS {
+		if isCorsPreflight(req) && !corsAllowed {
+			writeErr(rew, req, false, ErrPubForbidden(errors.Errorf(
+				`origin %q is not allowed`, req.Header.Get("origin"),
+			)))
+			return
+		}
+		rew.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	err := errNorm(rout.Route(rew, req, routes))
-	writeErr(rew, req, false, err)
+	writeErr(rew, req, false, routeRequest(rew, req, routes))
+}
+
+/*
+"rout" recovers from all panics in handlers, including `http.ErrAbortHandler`,
+and returns them as errors. We re-panic the latter outside the router, which
+lets "net/http" abort the response and drop the connection, instead of writing
+an error response. See `recWriteErr`.
+*/
+func routeRequest(rew Rew, req *Req, routes func(rout.R)) error {
+	err := rout.Route(rew, req, routes)
+	if errors.Is(err, http.ErrAbortHandler) {
+		panic(http.ErrAbortHandler)
+	}
+	return errNorm(err)
 }
 
 func routes(r rout.R) {
 	r.Sub(`^/api/v1(?:/|$)`, routesApi)
-	r.Get(``, env.fileServer.ServeHTTP)
+	r.Get(routed(`^/metrics$`, serveMetrics))
+	// "net/http" handles HEAD in `http.ServeContent`.
+	r.Methods(`^/`, func(r rout.MR) {
+		_, fun := routed(`^/`, serveStatic)
+		r.Get(fun)
+		r.Head(fun)
+	})
 }
 
 func routesApi(r rout.R) {
-	r.Get(`^/api/v1$`, apiHealthCheck)
+	preventCaching(r.Rew.Header())
+
+	r.Get(routed(`^/api/v1$`, apiHealthCheck))
+	r.Get(routed(`^/api/v1/health/live$`, apiHealthCheck))
+	r.Get(routed(`^/api/v1/health/ready$`, apiHealthReady))
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// One year, the conventional maximum.
+const STATIC_IMMUTABLE_MAX_AGE = 365 * 24 * time.Hour
+
+/*
+Precompressed variants of static files, in order of preference. A variant is a
+sibling file with an additional extension, for example "main.js.br".
+*/
+var STATIC_ENCODINGS = []struct{ Encoding, Ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+/*
+Takes priority over `mime.TypeByExtension`, whose results depend on the system
+MIME database and are often missing or outdated for these types.
+*/
+var STATIC_MIME_TYPES = map[string]string{
+	".css":         "text/css; charset=utf-8",
+	".html":        "text/html; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".wasm":        "application/wasm",
+	".svg":         "image/svg+xml",
+	".ico":         "image/x-icon",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".txt":         "text/plain; charset=utf-8",
+}
+
+/*
+Serves files from `Conf.PublicDir`. Directories are served via their
+"index.html" and never listed. Precompressed ".br" and ".gz" siblings are
+served to clients that accept the corresponding encoding.
+
+When `Conf.StaticSpaFallback` is set, missing files are served from the root
+"index.html", which lets a single-page app handle client-side routes. See
+`isStaticSpaRoute` for the exceptions.
+
+Fingerprinted assets, whose paths match `Conf.StaticImmutablePattern`, are
+cached indefinitely: when their content changes, so do their URLs. Other files
+must be revalidated on each use. "net/http" responds with 304 when the ETag or
+Last-Modified date matches, which makes revalidation cheap.
+*/
+func serveStatic(rew Rew, req *Req) {
+	reqName := path.Clean("/" + req.URL.Path)
+
+	file, stat, name, err := openStatic(reqName)
+	if errors.Is(err, os.ErrNotExist) && isStaticSpaRoute(req, reqName) {
+		file, stat, name, err = openStatic("/index.html")
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		writeErr(rew, req, false, ErrPubNotFound(errors.Errorf(`file %q not found`, req.URL.Path)))
+		return
+	}
+	if err != nil {
+		writeErr(rew, req, false, err)
+		return
+	}
+	defer file.Close()
+
+	header := rew.Header()
+	addVary(header, "accept-encoding")
+
+	encoding := ""
+	encFile, encStat, enc := openStaticEncoded(req, name)
+	if encFile != nil {
+		defer encFile.Close()
+		file, stat, encoding = encFile, encStat, enc
+		header.Set("content-encoding", encoding)
+	}
+
+	// Must be set explicitly for encoded variants, because sniffing the content
+	// would detect the compression format.
+	header.Set("content-type", staticMimeType(name))
+
+	if isStaticImmutable(name) {
+		setCacheControl(header, fmt.Sprintf(
+			"public, max-age=%v, immutable", int64(STATIC_IMMUTABLE_MAX_AGE/time.Second),
+		))
+	} else {
+		setCacheControl(header, "no-cache")
+	}
+	header.Set("etag", staticEtag(stat, encoding))
+
+	http.ServeContent(rew, req, name, stat.ModTime(), file)
+}
+
+/*
+Opens a file in `Conf.PublicDir`. For directories, opens their "index.html"
+instead. Returns the name of the opened file.
+*/
+// Unknown API routes, such as other API versions, must not look like pages.
+var staticSpaExcludeRegexp = regexp.MustCompile(`^/api(?:/|$)`)
+
+/*
+Missing files with an extension, such as stale bundles, and unknown API routes
+are still 404. The client must explicitly accept HTML, which browsers do when
+navigating, while "fetch" and most HTTP clients send a wildcard or nothing.
+*/
+func isStaticSpaRoute(req *Req, reqName string) bool {
+	return env.conf.StaticSpaFallback &&
+		path.Ext(reqName) == "" &&
+		!staticSpaExcludeRegexp.MatchString(reqName) &&
+		acceptsHtml(req.Header)
+}
+
+func acceptsHtml(header http.Header) bool {
+	for _, item := range parseAcceptHeader(header, "accept") {
+		if item.Value == "text/html" {
+			return item.Quality > 0
+		}
+	}
+	return false
+}
+
+// Takes the path of the served file, starting with "/".
+func isStaticImmutable(name string) bool {
+	return env.staticImmutable != nil && env.staticImmutable.MatchString(name)
+}
+
+func openStatic(name string) (http.File, os.FileInfo, string, error) {
+	dir := http.Dir(env.conf.PublicDir)
+
+	file, stat, err := openFile(dir, name)
+	if err != nil {
+		return nil, nil, name, err
+	}
+	if !stat.IsDir() {
+		return file, stat, name, nil
+	}
+	file.Close()
+
+	name = path.Join(name, "index.html")
+	file, stat, err = openFile(dir, name)
+	if err == nil && stat.IsDir() {
+		file.Close()
+		return nil, nil, name, errors.WithStack(os.ErrNotExist)
+	}
+	return file, stat, name, err
+}
+
+// Returns nil if there's no suitable precompressed variant.
+func openStaticEncoded(req *Req, name string) (http.File, os.FileInfo, string) {
+	dir := http.Dir(env.conf.PublicDir)
+
+	for _, variant := range STATIC_ENCODINGS {
+		if !acceptsEncoding(req.Header, variant.Encoding) {
+			continue
+		}
+		file, stat, err := openFile(dir, name+variant.Ext)
+		if err != nil {
+			continue
+		}
+		if stat.IsDir() {
+			file.Close()
+			continue
+		}
+		return file, stat, variant.Encoding
+	}
+	return nil, nil, ""
+}
+
+func openFile(fs http.FileSystem, name string) (http.File, os.FileInfo, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, errors.WithStack(err)
+	}
+	return file, stat, nil
+}
+
+func staticMimeType(name string) string {
+	ext := path.Ext(name)
+	typ := STATIC_MIME_TYPES[ext]
+	if typ == "" {
+		typ = mime.TypeByExtension(ext)
+	}
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	return typ
+}
+
+/*
+Derived from the modification time and size, like in Nginx, which avoids
+reading the file. Encoded variants have different ETags, as required by the
+HTTP spec.
+*/
+func staticEtag(stat os.FileInfo, encoding string) string {
+	if encoding != "" {
+		return fmt.Sprintf(`"%x-%x-%v"`, stat.ModTime().Unix(), stat.Size(), encoding)
+	}
+	return fmt.Sprintf(`"%x-%x"`, stat.ModTime().Unix(), stat.Size())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/mitranim/rout"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// Doesn't need the DB.
+func TestCompressRewDiscard(t *T) {
+	routes := func(r rout.R) {
+		r.Get(`^/late_err$`, func(rew Rew, req *Req) {
+			header := rew.Header()
+			addVary(header, "accept-encoding")
+			header.Set("content-type", "text/javascript; charset=utf-8")
+			header.Set("content-language", "de")
+			header.Set("content-disposition", `attachment; filename="main.js"`)
+			header.Set("accept-ranges", "bytes")
+			header.Set("etag", `"123"`)
+			rew.WriteHeader(http.StatusOK)
+			_, _ = rew.Write([]byte(`buffered`))
+
+			writeErr(rew, req, false, errors.New(`late error`))
+		})
+	}
+
+	req := selfReq(context.Background(), TestSess{}, HttpReqParams{Method: GET, Url: `/late_err`})
+	req.Header.Set("origin", "https://example.com")
+	req.Header.Set("accept", MIME_TYPE_JSON)
+	rew := httptest.NewRecorder()
+	handleRequestWith(rew, req, routes)
+
+	header := rew.Header()
+	require.Equal(t, http.StatusInternalServerError, rew.Code)
+	require.NotContains(t, rew.Body.String(), `buffered`)
+	require.Equal(t, MIME_TYPE_JSON, header.Get("content-type"))
+	require.Empty(t, header.Get("content-encoding"))
+	require.Empty(t, header.Get("content-language"))
+	require.Empty(t, header.Get("content-disposition"))
+	require.Empty(t, header.Get("accept-ranges"))
+	require.Empty(t, header.Get("etag"))
+
+	// The error is compressible, so "accept-encoding" is added again.
+	require.Equal(t, []string{"origin", "accept-encoding"}, header.Values("vary"))
+}
+
+func TestDelVary(t *T) {
+	header := http.Header{}
+	header.Add("vary", "origin, Accept-Encoding")
+	header.Add("vary", "accept-language")
+
+	delVary(header, "accept-encoding")
+	require.Equal(t, []string{"origin", "accept-language"}, header.Values("vary"))
+
+	delVary(header, "origin")
+	delVary(header, "accept-language")
+	require.Empty(t, header.Values("vary"))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+Replaces the pools in `env` with ones that never connect, which is enough for
+routing decisions. Doesn't need the DB.
+*/
+func testDbReplica(t TB, up bool) (primary *sql.DB, replica *sql.DB) {
+	prevDb, prevReplica := env.db, env.dbReplica
+	prevUp := atomic.LoadInt32(&env.dbReplicaUp)
+	t.Cleanup(func() {
+		env.db, env.dbReplica = prevDb, prevReplica
+		atomic.StoreInt32(&env.dbReplicaUp, prevUp)
+	})
+
+	primary, err := openDb(env.conf)
+	require.NoError(t, err)
+	t.Cleanup(func() { primary.Close() })
+
+	replica, err = openDb(env.conf.ReplicaConf())
+	require.NoError(t, err)
+	t.Cleanup(func() { replica.Close() })
+
+	env.db, env.dbReplica = primary, replica
+	setDbReplicaUp(nil)
+	if !up {
+		setDbReplicaUp(errors.New(`unavailable`))
+	}
+	return primary, replica
+}
+
+func TestDbForTx(t *T) {
+	primary, replica := testDbReplica(t, true)
+
+	test := func(exp *sql.DB, opts DbTxOpts) {
+		t.Helper()
+		require.True(t, exp == dbForTx(opts), `%+v`, opts)
+	}
+
+	t.Run(`read-only transactions go to the replica`, func(t *T) {
+		test(replica, DbTxOpts{ReadOnly: true})
+		test(replica, DbTxOpts{ReadOnly: true, Isolation: sql.LevelRepeatableRead})
+	})
+
+	t.Run(`other transactions go to the primary`, func(t *T) {
+		test(primary, DbTxOpts{})
+		test(primary, DbTxOpts{Isolation: sql.LevelRepeatableRead})
+		test(primary, DbTxOpts{ReadOnly: true, Primary: true})
+		test(primary, DbTxOpts{ReadOnly: true, Isolation: sql.LevelSerializable})
+	})
+
+	t.Run(`unavailable replica`, func(t *T) {
+		testDbReplica(t, false)
+		test(env.db, DbTxOpts{ReadOnly: true})
+	})
+
+	t.Run(`no replica`, func(t *T) {
+		testDbReplica(t, true)
+		env.dbReplica = nil
+		test(env.db, DbTxOpts{ReadOnly: true})
+	})
+}
+
+func TestSetDbReplicaUp(t *T) {
+	testDbReplica(t, true)
+
+	setDbReplicaUp(errors.New(`unavailable`))
+	require.Equal(t, int32(0), atomic.LoadInt32(&env.dbReplicaUp))
+
+	setDbReplicaUp(nil)
+	require.Equal(t, int32(1), atomic.LoadInt32(&env.dbReplicaUp))
+}
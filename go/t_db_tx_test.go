@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func testErrSerialization() error {
+	return errors.WithStack(&pq.Error{Code: POSTGRES_ERROR_CODE_SERIALIZATION_FAILURE})
+}
+
+func testDbTxRetries() uint64 {
+	env.metrics.lock.Lock()
+	defer env.metrics.lock.Unlock()
+	return env.metrics.dbTxRetries[POSTGRES_ERROR_CODE_SERIALIZATION_FAILURE]
+}
+
+func TestWithDbTxRetry(t *T) {
+	// The test transaction is deliberately not in the context, which makes
+	// `withDbTxOpts` create its own transactions.
+	ctx, _ := testInit(t)
+
+	t.Run(`retries up to MaxAttempts`, func(t *T) {
+		retries := testDbTxRetries()
+
+		var count int
+		err := withDbTxOpts(ctx, DbTxOpts{MaxAttempts: 3}, func(Ctx, DbTx) error {
+			count++
+			return testErrSerialization()
+		})
+		require.True(t, isErrDbRetryable(err), `%+v`, err)
+		require.Equal(t, 3, count)
+		require.Equal(t, retries+2, testDbTxRetries())
+	})
+
+	t.Run(`stops after success`, func(t *T) {
+		var count int
+		err := withDbTxOpts(ctx, DbTxOpts{MaxAttempts: 3}, func(Ctx, DbTx) error {
+			count++
+			if count == 1 {
+				return testErrSerialization()
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 2, count)
+	})
+
+	t.Run(`doesn't retry other errors`, func(t *T) {
+		var count int
+		err := withDbTxOpts(ctx, DbTxOpts{MaxAttempts: 3}, func(Ctx, DbTx) error {
+			count++
+			return errors.New(`unexpected`)
+		})
+		require.Error(t, err)
+		require.Equal(t, 1, count)
+	})
+
+	t.Run(`doesn't retry by default`, func(t *T) {
+		var count int
+		err := withDbTx(ctx, func(Ctx, DbTx) error {
+			count++
+			return testErrSerialization()
+		})
+		require.Error(t, err)
+		require.Equal(t, 1, count)
+	})
+
+	t.Run(`doesn't retry a transaction from the context`, func(t *T) {
+		ctx, tx := testInit(t)
+		ctx = ctxWithDbTx(ctx, tx)
+
+		var count int
+		err := withDbTxOpts(ctx, DbTxOpts{MaxAttempts: 3}, func(_ Ctx, conn DbTx) error {
+			count++
+			require.Equal(t, tx, conn)
+			return testErrSerialization()
+		})
+		require.True(t, isErrDbRetryable(err), `%+v`, err)
+		require.Equal(t, 1, count)
+	})
+}
+
+func TestWithDbSavepoint(t *T) {
+	ctx, tx := testInit(t)
+	ctx = ctxWithDbTx(ctx, tx)
+
+	require.NoError(t, dbExec(ctx, tx, `
+		create temp table test_savepoints (
+			val text not null constraint "db.constraint.test_savepoints_val_unique" unique
+		) on commit drop
+	`, nil))
+	require.NoError(t, dbExec(ctx, tx, `insert into test_savepoints (val) values ('one')`, nil))
+
+	count := func() (out int64) {
+		require.NoError(t, SqlQueryOrd(`select count(*) from test_savepoints`).Query(ctx, tx, &out))
+		return
+	}
+
+	t.Run(`rolls back on error, keeping the outer transaction usable`, func(t *T) {
+		err := withDbSavepoint(ctx, func(ctx Ctx, conn DbTx) error {
+			require.Equal(t, tx, conn)
+			return dbExec(ctx, conn, `insert into test_savepoints (val) values ('one')`, nil)
+		})
+		require.True(t, isPgErrWithCode(err, POSTGRES_ERROR_CODE_UNIQUE_VIOLATION), `%+v`, err)
+		require.Equal(t, int64(1), count())
+	})
+
+	t.Run(`rolls back on panic`, func(t *T) {
+		err := withDbSavepoint(ctx, func(ctx Ctx, conn DbTx) error {
+			require.NoError(t, dbExec(ctx, conn, `insert into test_savepoints (val) values ('two')`, nil))
+			panic(errors.New(`unexpected`))
+		})
+		require.Error(t, err)
+		require.Equal(t, int64(1), count())
+	})
+
+	t.Run(`keeps changes on success`, func(t *T) {
+		err := withDbSavepoint(ctx, func(ctx Ctx, conn DbTx) error {
+			return dbExec(ctx, conn, `insert into test_savepoints (val) values ('two')`, nil)
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(2), count())
+	})
+
+	t.Run(`supports nesting`, func(t *T) {
+		err := withDbSavepoint(ctx, func(ctx Ctx, conn DbTx) error {
+			require.NoError(t, dbExec(ctx, conn, `insert into test_savepoints (val) values ('three')`, nil))
+
+			err := withDbSavepoint(ctx, func(ctx Ctx, conn DbTx) error {
+				return dbExec(ctx, conn, `insert into test_savepoints (val) values ('three')`, nil)
+			})
+			require.True(t, isPgErrWithCode(err, POSTGRES_ERROR_CODE_UNIQUE_VIOLATION), `%+v`, err)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(3), count())
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrHttpStatus(t *T) {
+	live := context.Background()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	t.Cleanup(cancel)
+
+	queryCanceled := errors.WithStack(&pq.Error{Code: POSTGRES_ERROR_CODE_QUERY_CANCELED})
+
+	test := func(exp int, ctx Ctx, err error) {
+		t.Helper()
+		require.Equal(t, exp, errHttpStatus(ctx, err), `%+v`, err)
+	}
+
+	t.Run(`client disconnect`, func(t *T) {
+		test(HTTP_STATUS_CLIENT_CLOSED_REQUEST, canceled, context.Canceled)
+		test(HTTP_STATUS_CLIENT_CLOSED_REQUEST, canceled, queryCanceled)
+		test(HTTP_STATUS_CLIENT_CLOSED_REQUEST, canceled, sql.ErrTxDone)
+	})
+
+	t.Run(`cancellation without a canceled context`, func(t *T) {
+		test(http.StatusInternalServerError, live, context.Canceled)
+		test(http.StatusInternalServerError, nil, context.Canceled)
+		test(http.StatusInternalServerError, live, sql.ErrTxDone)
+	})
+
+	t.Run(`timeout`, func(t *T) {
+		test(http.StatusGatewayTimeout, expired, context.DeadlineExceeded)
+		test(http.StatusGatewayTimeout, live, context.DeadlineExceeded)
+		test(http.StatusGatewayTimeout, live, queryCanceled)
+	})
+
+	t.Run(`other`, func(t *T) {
+		test(http.StatusNotFound, live, ErrPubNotFound(errors.New(`missing`)))
+		test(http.StatusServiceUnavailable, live, testErrSerialization())
+		test(http.StatusBadRequest, canceled, ErrPubBadRequest(errors.New(`invalid`)))
+		test(http.StatusInternalServerError, live, errors.New(`unexpected`))
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAcceptHeader(t *T) {
+	test := func(exp []AcceptItem, vals ...string) {
+		t.Helper()
+		header := http.Header{}
+		for _, val := range vals {
+			header.Add("accept", val)
+		}
+		require.Equal(t, exp, parseAcceptHeader(header, "accept"))
+	}
+
+	test(nil)
+	test(nil, ``)
+	test(nil, ` , ,`)
+
+	test([]AcceptItem{{`text/html`, 1}}, `text/html`)
+	test([]AcceptItem{{`text/html`, 1}}, ` Text/HTML `)
+
+	test(
+		[]AcceptItem{{`text/html`, 1}, {`application/json`, 0.5}, {`*/*`, 0}},
+		`text/html, application/json;q=0.5, */*; Q=0`,
+	)
+
+	t.Run(`drops other parameters`, func(t *T) {
+		test([]AcceptItem{{`text/html`, 0.8}}, `text/html; level=1; q=0.8`)
+		test([]AcceptItem{{`text/plain`, 1}}, `text/plain; charset=utf-8`)
+	})
+
+	t.Run(`skips malformed qualities`, func(t *T) {
+		test([]AcceptItem{{`application/json`, 1}}, `text/html;q=high, application/json`)
+	})
+
+	t.Run(`combines header lines`, func(t *T) {
+		test(
+			[]AcceptItem{{`text/html`, 1}, {`application/json`, 0.9}},
+			`text/html`, `application/json;q=0.9`,
+		)
+	})
+}
+
+func TestNegotiateMediaType(t *T) {
+	test := func(exp string, accept string, offers ...string) {
+		t.Helper()
+		header := http.Header{}
+		if accept != `` {
+			header.Set("accept", accept)
+		}
+		require.Equal(t, exp, negotiateMediaType(header, offers...))
+	}
+
+	t.Run(`without accept, prefers the first offer`, func(t *T) {
+		test(MIME_TYPE_JSON, ``, MIME_TYPE_JSON, MIME_TYPE_NDJSON)
+		test(``, ``)
+	})
+
+	t.Run(`exact match`, func(t *T) {
+		test(MIME_TYPE_NDJSON, MIME_TYPE_NDJSON, MIME_TYPE_JSON, MIME_TYPE_NDJSON)
+		test(MIME_TYPE_JSON, `Application/JSON`, MIME_TYPE_JSON, MIME_TYPE_NDJSON)
+	})
+
+	t.Run(`quality`, func(t *T) {
+		test(MIME_TYPE_NDJSON, `application/json;q=0.5, application/x-ndjson`, MIME_TYPE_JSON, MIME_TYPE_NDJSON)
+		test(MIME_TYPE_JSON, `application/json, application/x-ndjson;q=0.5`, MIME_TYPE_NDJSON, MIME_TYPE_JSON)
+	})
+
+	t.Run(`ties go to the earlier offer`, func(t *T) {
+		test(MIME_TYPE_JSON, `*/*`, MIME_TYPE_JSON, MIME_TYPE_NDJSON)
+		test(MIME_TYPE_NDJSON, `application/*`, MIME_TYPE_NDJSON, MIME_TYPE_JSON)
+	})
+
+	t.Run(`the most specific range wins`, func(t *T) {
+		test(MIME_TYPE_NDJSON, `*/*, application/json;q=0`, MIME_TYPE_JSON, MIME_TYPE_NDJSON)
+		test(MIME_TYPE_TEXT, `text/*, application/*;q=0.5`, MIME_TYPE_JSON, MIME_TYPE_TEXT)
+	})
+
+	t.Run(`nothing acceptable`, func(t *T) {
+		test(``, `text/html`, MIME_TYPE_JSON, MIME_TYPE_NDJSON)
+		test(``, `application/json;q=0`, MIME_TYPE_JSON)
+	})
+}
+
+func testCorsConf(t TB, origins []string, credentials bool) {
+	prev := env.conf
+	t.Cleanup(func() { env.conf = prev })
+	env.conf.CorsOrigins = origins
+	env.conf.CorsCredentials = credentials
+}
+
+func TestIsCorsOriginAllowed(t *T) {
+	testCorsConf(t, []string{`https://example.com`, `https://*.example.com`, `http://localhost:*`}, true)
+
+	test := func(exp bool, origin string) {
+		t.Helper()
+		require.Equal(t, exp, isCorsOriginAllowed(origin), origin)
+	}
+
+	test(true, `https://example.com`)
+	test(true, `https://app.example.com`)
+	test(true, `http://localhost:3000`)
+
+	test(false, ``)
+	test(false, `http://example.com`)
+	test(false, `https://example.com.evil.com`)
+	test(false, `https://evilexample.com`)
+	test(false, `https://localhost:3000`)
+	test(false, `null`)
+
+	t.Run(`wildcard`, func(t *T) {
+		testCorsConf(t, []string{`*`}, false)
+		test(true, `https://evil.com`)
+	})
+
+	t.Run(`nothing configured`, func(t *T) {
+		testCorsConf(t, nil, false)
+		test(false, `https://example.com`)
+	})
+}
+
+func TestAllowCors(t *T) {
+	testCorsConf(t, []string{`https://example.com`}, true)
+
+	test := func(origin string) (bool, http.Header) {
+		req := selfReq(context.Background(), TestSess{}, HttpReqParams{Method: GET, Url: `/`})
+		if origin != `` {
+			req.Header.Set(`origin`, origin)
+		}
+		header := http.Header{}
+		return allowCors(header, req), header
+	}
+
+	t.Run(`allowed origin is reflected`, func(t *T) {
+		ok, header := test(`https://example.com`)
+		require.True(t, ok)
+		require.Equal(t, `https://example.com`, header.Get(`access-control-allow-origin`))
+		require.Equal(t, `true`, header.Get(`access-control-allow-credentials`))
+		require.Equal(t, []string{`origin`}, header.Values(`vary`))
+	})
+
+	t.Run(`other origins get no CORS headers`, func(t *T) {
+		ok, header := test(`https://evil.com`)
+		require.False(t, ok)
+		require.Empty(t, header.Get(`access-control-allow-origin`))
+		require.Empty(t, header.Get(`access-control-allow-credentials`))
+		require.Equal(t, []string{`origin`}, header.Values(`vary`))
+	})
+
+	t.Run(`same-origin requests are allowed`, func(t *T) {
+		ok, header := test(``)
+		require.True(t, ok)
+		require.Empty(t, header.Get(`access-control-allow-origin`))
+	})
+}
+
+func TestValidateCorsOrigins(t *T) {
+	testCorsConf(t, []string{`https://*.example.com`, `*`}, false)
+	require.NoError(t, validateCorsOrigins())
+
+	testCorsConf(t, []string{`*`}, true)
+	require.Error(t, validateCorsOrigins())
+
+	testCorsConf(t, []string{`https://[example.com`}, false)
+	require.Error(t, validateCorsOrigins())
+}
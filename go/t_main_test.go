@@ -1,22 +1,33 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"testing"
 
 	_ "starter/go/testhack"
-
-	"github.com/mitranim/try"
 )
 
+/*
+Set when `initServer` fails, usually because the DB is unavailable. Tests that
+don't need the DB still run; `testInit` fails the others.
+*/
+var testInitErr error
+
 func TestMain(m *testing.M) {
 	// Auto-select a free port to avoid conflicts with the main server process.
 	env.conf.ServerPort = 0
 
+	// Tests expect a running DB; there's no point in waiting for one.
+	env.conf.PostgresStartupTimeout = 0
+
 	// Note: this doesn't actually start the server. We "fake" our HTTP requests,
 	// which allows us to pass the test DB transaction to the request handlers.
 	// See `testInit` and `selfJsonFetch`.
-	try.To(initServer())
+	testInitErr = initServer()
+	if testInitErr != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize the server; tests that need it will fail: %v\n", testInitErr)
+	}
 
 	os.Exit(m.Run())
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testMetricsToken = `test_metrics_token`
+
+func TestMetrics(t *T) {
+	ctx, _ := testInit(t)
+
+	prev := env.conf.MetricsToken
+	env.conf.MetricsToken = testMetricsToken
+	t.Cleanup(func() { env.conf.MetricsToken = prev })
+
+	const (
+		okSeries    = `http_requests_total{method="GET",route="^/api/v1/health/live$",status="200"}`
+		countSeries = `http_request_duration_seconds_count{method="GET",route="^/api/v1/health/live$"}`
+		infSeries   = `http_request_duration_seconds_bucket{method="GET",route="^/api/v1/health/live$",le="+Inf"}`
+		errSeries   = `http_errors_total{db_code="",status="404"}`
+	)
+
+	before := tFetchMetrics(t, ctx)
+
+	_, err := selfHttpFetch(ctx, TestSess{}, GET, `/api/v1/health/live`, nil)
+	require.NoError(t, err)
+
+	_, err = selfHttpFetch(ctx, TestSess{}, GET, `/api/v1/missing`, nil)
+	require.Error(t, err)
+
+	after := tFetchMetrics(t, ctx)
+
+	require.Equal(t, metricsValue(before, okSeries)+1, metricsValue(after, okSeries))
+	require.Equal(t, metricsValue(before, countSeries)+1, metricsValue(after, countSeries))
+	require.Equal(t, metricsValue(after, countSeries), metricsValue(after, infSeries))
+	require.Equal(t, metricsValue(before, errSeries)+1, metricsValue(after, errSeries))
+
+	// Includes the current request.
+	require.GreaterOrEqual(t, metricsValue(after, `http_requests_in_flight`), float64(1))
+	require.Contains(t, after, "\ndb_pool_open_connections ")
+	require.Contains(t, after, "\n# TYPE http_request_duration_seconds histogram\n")
+}
+
+// Doesn't need the DB.
+func TestMetricsAuth(t *T) {
+	ctx := context.Background()
+
+	prev := env.conf.MetricsToken
+	t.Cleanup(func() { env.conf.MetricsToken = prev })
+
+	env.conf.MetricsToken = ``
+	_, err := selfHttpFetch(ctx, TestSess{}, GET, `/metrics`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `code: 404`)
+
+	env.conf.MetricsToken = testMetricsToken
+
+	test := func(status string, auth string) {
+		t.Helper()
+		_, err := selfHttpFetchWith(ctx, TestSess{}, HttpReqParams{
+			Method: GET,
+			Url:    `/metrics`,
+			Header: httpHead(`authorization`, auth),
+		})
+		if status == `` {
+			require.NoError(t, err)
+		} else {
+			require.Error(t, err)
+			require.Contains(t, err.Error(), status)
+		}
+	}
+
+	test(`code: 401`, `Bearer wrong`)
+	test(`code: 401`, testMetricsToken)
+	test(`code: 401`, `Basic `+testMetricsToken)
+	test(`code: 401`, `Bearer`)
+	test(``, `Bearer `+testMetricsToken)
+	test(``, `bearer `+testMetricsToken)
+	test(``, `BEARER `+testMetricsToken)
+}
+
+func tFetchMetrics(t TB, ctx Ctx) string {
+	body, err := selfHttpFetchWith(ctx, TestSess{}, HttpReqParams{
+		Method: GET,
+		Url:    `/metrics`,
+		Header: httpHead(`authorization`, `Bearer `+testMetricsToken),
+	})
+	require.NoError(t, err)
+	return string(body)
+}
+
+// Returns the value of the series, or 0 if it's missing.
+func metricsValue(text string, series string) float64 {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			val, _ := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			return val
+		}
+	}
+	return 0
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/mitranim/rout"
+	"github.com/stretchr/testify/require"
+)
+
+// Doesn't need the DB.
+func TestHandlerAbort(t *T) {
+	routes := func(r rout.R) {
+		r.Get(`^/abort$`, func(rew Rew, _ *Req) {
+			rew.Header().Set(`content-type`, MIME_TYPE_TEXT)
+			panic(http.ErrAbortHandler)
+		})
+		r.Get(`^/panic$`, func(Rew, *Req) { panic(`unexpected`) })
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rew Rew, req *Req) {
+		handleRequestWith(rew, req, routes)
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Run(`drops the connection on http.ErrAbortHandler`, func(t *T) {
+		res, err := http.Get(srv.URL + `/abort`)
+		if err == nil {
+			res.Body.Close()
+		}
+		require.Error(t, err)
+	})
+
+	t.Run(`responds with 500 to other panics`, func(t *T) {
+		res, err := http.Get(srv.URL + `/panic`)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	})
+}
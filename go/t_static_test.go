@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Uses the configured pattern, which is the default unless overridden in the
+// environment.
+func testStaticImmutable(t TB) {
+	prev := env.staticImmutable
+	t.Cleanup(func() { env.staticImmutable = prev })
+	env.staticImmutable = regexp.MustCompile(env.conf.StaticImmutablePattern)
+}
+
+func TestStaticImmutablePattern(t *T) {
+	testStaticImmutable(t)
+
+	test := func(exp bool, name string) {
+		t.Helper()
+		require.Equal(t, exp, isStaticImmutable(name), name)
+	}
+
+	t.Run(`bundler output`, func(t *T) {
+		// Vite and Rollup.
+		test(true, `/assets/index-BkP3x_9a.js`)
+		test(true, `/assets/index-D-3xQmZk.css`)
+		test(true, `/assets/vendor-C_jsn2Ve.js.map`)
+		test(true, `/assets/logo-Dk4V9bTz.svg`)
+		// esbuild.
+		test(true, `/assets/main-2UJAQTLN.js`)
+		test(true, `/assets/chunk-7XH3OZSQ.js`)
+		// webpack and Create React App.
+		test(true, `/static/js/main.8f3a2c1e.js`)
+		test(true, `/static/js/787.a1b2c3d4.chunk.js`)
+		test(true, `/static/css/main.0123456789abcdef.css`)
+		test(true, `/static/media/logo.6ce24c58023cc2f8fd88fe9d219db6c6.svg`)
+		// Next.js.
+		test(true, `/_next/static/chunks/pages/index-0123456789abcdef.js`)
+		test(true, `/_next/static/css/5e8c4a9b1f2d3e7a.css`)
+		// Parcel.
+		test(true, `/build/index.3f2a1b9c.js`)
+	})
+
+	t.Run(`unfingerprinted`, func(t *T) {
+		test(false, `/index.html`)
+		test(false, `/favicon.ico`)
+		test(false, `/robots.txt`)
+		test(false, `/assets/index.js`)
+		test(false, `/static/js/main.js`)
+		test(false, `/assets/app-1.2.3.js`)
+		test(false, `/assets/logo-abc.png`)
+	})
+
+	t.Run(`outside build directories`, func(t *T) {
+		test(false, `/index-BkP3x_9a.js`)
+		test(false, `/docs/report-2024-01-01.pdf`)
+		test(false, `/images/background-mountains.jpg`)
+		test(false, `/vendor/library.min.js`)
+		test(false, `/assetsx/index-BkP3x_9a.js`)
+	})
+}
+
+func TestStaticSpaFallback(t *T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, `assets`), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, `index.html`), []byte(`<p>index</p>`), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, `assets`, `main.js`), []byte(`main`), os.ModePerm))
+
+	prev := env.conf
+	t.Cleanup(func() { env.conf = prev })
+	env.conf.PublicDir = dir
+	env.conf.StaticSpaFallback = true
+
+	const html = `text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8`
+
+	test := func(status string, url string, accept string) {
+		t.Helper()
+		body, err := selfHttpFetchWith(context.Background(), TestSess{}, HttpReqParams{
+			Method: GET,
+			Url:    url,
+			Header: httpHead(`accept`, accept),
+		})
+		if status == `` {
+			require.NoError(t, err)
+			require.Equal(t, `<p>index</p>`, string(body))
+		} else {
+			require.Error(t, err)
+			require.Contains(t, err.Error(), status)
+		}
+	}
+
+	t.Run(`serves index.html for page navigation`, func(t *T) {
+		test(``, `/`, html)
+		test(``, `/users/123`, html)
+		test(``, `/apis`, html)
+	})
+
+	t.Run(`unknown API routes are 404`, func(t *T) {
+		test(`code: 404`, `/api`, html)
+		test(`code: 404`, `/api/v2/x`, html)
+		test(`code: 404`, `/api/v2/x`, MIME_TYPE_JSON)
+	})
+
+	t.Run(`requires accepting HTML`, func(t *T) {
+		test(`code: 404`, `/users/123`, MIME_TYPE_JSON)
+		test(`code: 404`, `/users/123`, `*/*`)
+		test(`code: 404`, `/users/123`, ``)
+		test(`code: 404`, `/users/123`, `text/html;q=0, */*`)
+	})
+
+	t.Run(`missing files with an extension are 404`, func(t *T) {
+		test(`code: 404`, `/assets/missing.js`, html)
+	})
+}
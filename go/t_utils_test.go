@@ -39,6 +39,8 @@ Known deficiency: using global state to share context between tests and other
 parts of the app makes it impossible to run tests concurrenly with each other.
 */
 func testInit(t TB) (Ctx, DbTx) {
+	require.NoError(t, testInitErr, `server initialization failed`)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	t.Cleanup(cancel)
 
@@ -49,8 +51,13 @@ func testInit(t TB) (Ctx, DbTx) {
 }
 
 func selfHttpFetch(ctx Ctx, sess TestSess, method string, path string, body []byte) ([]byte, error) {
+	return selfHttpFetchWith(ctx, sess, HttpReqParams{Method: method, Url: path, Body: body})
+}
+
+// Same as `selfHttpFetch`, but allows to specify headers.
+func selfHttpFetchWith(ctx Ctx, sess TestSess, params HttpReqParams) ([]byte, error) {
 	rew := httptest.NewRecorder()
-	req := selfReq(ctx, sess, HttpReqParams{Method: method, Url: path, Body: body})
+	req := selfReq(ctx, sess, params)
 	handleRequest(rew, req)
 	return rew.Body.Bytes(), selfReqErr(rew)
 }
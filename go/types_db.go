@@ -1,6 +1,8 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
 	"time"
 )
 
@@ -8,3 +10,60 @@ type Timed struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
+
+/*
+Options for transactions created by `withDbTxOpts`. Zero values mean defaults:
+the isolation level and timeouts configured in the DB, read-write mode, a single
+attempt, and no savepoint.
+
+The timeouts are applied with "set local" at the start of the transaction and
+last until its end. They're useful for keeping short endpoints short, and
+letting long ones, such as analytics, run longer than usual:
+
+	resWithDbTxOpts(rew, req, DbTxOpts{StatementTimeout: time.Second}, fun)
+*/
+type DbTxOpts struct {
+	Isolation        sql.IsolationLevel
+	ReadOnly         bool
+	StatementTimeout time.Duration
+	IdleInTxTimeout  time.Duration
+
+	// Total attempts for transactions failing with serialization conflicts or
+	// deadlocks. Mostly useful with `sql.LevelSerializable`.
+	MaxAttempts int
+
+	// When the transaction comes from the context, run within a savepoint. See
+	// `withDbSavepoint`.
+	Savepoint bool
+
+	// Run on the primary even when read-only, for reading recent writes. See
+	// `dbForTx`.
+	Primary bool
+}
+
+func (self DbTxOpts) TxOptions() *sql.TxOptions {
+	if self.Isolation == sql.LevelDefault && !self.ReadOnly {
+		return DEFAULT_DB_TX_OPTIONS
+	}
+	return &sql.TxOptions{Isolation: self.Isolation, ReadOnly: self.ReadOnly}
+}
+
+/*
+Statements that apply the timeouts. Postgres doesn't support parameters in
+"set", but the values are integers, which are safe to format.
+*/
+func (self DbTxOpts) SetLocalQueries() []string {
+	var out []string
+	if self.StatementTimeout > 0 {
+		out = append(out, fmt.Sprintf(`set local statement_timeout = %d`, durationToMs(self.StatementTimeout)))
+	}
+	if self.IdleInTxTimeout > 0 {
+		out = append(out, fmt.Sprintf(`set local idle_in_transaction_session_timeout = %d`, durationToMs(self.IdleInTxTimeout)))
+	}
+	return out
+}
+
+// Rounds up, because zero disables Postgres timeouts.
+func durationToMs(val time.Duration) int64 {
+	return int64((val + time.Millisecond - 1) / time.Millisecond)
+}
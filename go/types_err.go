@@ -32,6 +32,8 @@ type Error struct {
 	DbCode     DbCode `json:"dbCode"`
 	DbQuery    string `json:"dbQuery"`
 	DbContext  string `json:"dbContext"`
+	DbTable    string `json:"dbTable"`
+	DbColumn   string `json:"dbColumn"`
 }
 
 func (self Error) Error() string {
@@ -72,6 +74,17 @@ func (self Error) HttpStatusCode() int {
 	return http.StatusInternalServerError
 }
 
+/*
+Message without the status and code prefixes of `.Error`. Falls back on the
+status text when there's no cause.
+*/
+func (self Error) Message() string {
+	if self.Cause != nil {
+		return self.Cause.Error()
+	}
+	return http.StatusText(self.HttpStatusCode())
+}
+
 func (self Error) writeError(out io.Writer) {
 	self.writeErrorShallow(out)
 	if self.Cause != nil {
@@ -87,6 +100,9 @@ func (self Error) writeErrorShallow(out io.Writer) {
 	if self.DbCode != "" {
 		fmt.Fprintf(out, ` (DB code %v)`, self.DbCode)
 	}
+	if self.DbTable != "" || self.DbColumn != "" {
+		fmt.Fprintf(out, ` (DB table %q, column %q)`, self.DbTable, self.DbColumn)
+	}
 }
 
 func (self Error) writeErrorVerbose(out io.Writer) {
@@ -101,3 +117,92 @@ func (self Error) writeErrorVerbose(out io.Writer) {
 		fmt.Fprintf(out, `cause: %+v`, self.Cause)
 	}
 }
+
+/*
+JSON-encoded error response. For public errors (see `Error.IsPublic`) this
+exposes the message and DB code. For other errors, the message is opaque.
+*/
+type ErrRes struct {
+	Message    string `json:"message"`
+	DbCode     DbCode `json:"dbCode,omitempty"`
+	DbTable    string `json:"dbTable,omitempty"`
+	DbColumn   string `json:"dbColumn,omitempty"`
+	HttpStatus int    `json:"httpStatus"`
+	RequestId  string `json:"requestId,omitempty"`
+}
+
+/*
+For non-public errors, the HTTP status is guessed via `errHttpStatus`, while the
+message remains opaque.
+*/
+func ErrResFrom(ctx Ctx, err error) ErrRes {
+	pub, ok := errPub(err).(Error)
+	if ok {
+		return ErrRes{
+			Message:    pub.Message(),
+			DbCode:     pub.DbCode,
+			DbTable:    pub.DbTable,
+			DbColumn:   pub.DbColumn,
+			HttpStatus: pub.HttpStatusCode(),
+		}
+	}
+
+	status := errHttpStatus(ctx, err)
+	msg := ERR_MSG_UNEXPECTED
+	if status != http.StatusInternalServerError {
+		msg = strOr(http.StatusText(status), msg)
+	}
+	return ErrRes{Message: msg, HttpStatus: status}
+}
+
+/*
+Replaces the message of a public DB error with a human-readable one from
+`env.dbMessages`, if available. Returns the locale of the new message, or "".
+
+Constraint violations have constraint-specific codes. When there's no message
+for the constraint, falls back on the generic code of the Postgres error, such
+as "db.error.unique_violation".
+*/
+func (self *ErrRes) Localize(req *Req, err error) string {
+	if self.DbCode == "" {
+		return ""
+	}
+	msg, locale := env.dbMessages.Get(req.Header, self.DbCode)
+
+	var pgErr PgErr
+	if msg == "" && errors.As(err, &pgErr) {
+		msg, locale = env.dbMessages.Get(req.Header, pgErrDbCode(pgErr))
+	}
+
+	if msg != "" {
+		self.Message = msg
+	}
+	return locale
+}
+
+// RFC 7807 equivalent of `ErrRes`. Reference: https://tools.ietf.org/html/rfc7807.
+type ProblemRes struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	DbCode    DbCode `json:"dbCode,omitempty"`
+	DbTable   string `json:"dbTable,omitempty"`
+	DbColumn  string `json:"dbColumn,omitempty"`
+	RequestId string `json:"requestId,omitempty"`
+}
+
+func (self ErrRes) ProblemRes(req *Req) ProblemRes {
+	return ProblemRes{
+		Type:      "about:blank",
+		Title:     http.StatusText(self.HttpStatus),
+		Status:    self.HttpStatus,
+		Detail:    self.Message,
+		Instance:  req.URL.Path,
+		DbCode:    self.DbCode,
+		DbTable:   self.DbTable,
+		DbColumn:  self.DbColumn,
+		RequestId: self.RequestId,
+	}
+}
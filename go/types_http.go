@@ -6,6 +6,7 @@ functions. (Might also redesign the API.)
 */
 
 import (
+	"encoding/json"
 	"net/http"
 	"reflect"
 
@@ -22,8 +23,25 @@ func ReqdecFromReqQuery(req *Req) Reqdec {
 	return Reqdec{reqdec.FromReqQuery(req)}
 }
 
+/*
+Rejects bodies larger than `Conf.ServerMaxBodySize` with 413, either upfront
+via the declared content length, or while reading a body of unknown length
+(see `limitReqBody`).
+*/
 func DownloadReqdec(req *Req) (Reqdec, error) {
+	limit := env.conf.ServerMaxBodySize
+	if limit > 0 && req.ContentLength > limit {
+		return Reqdec{}, ErrPubRequestTooLarge(errors.Errorf(
+			`request body size %v exceeds the limit of %v bytes`, req.ContentLength, limit,
+		))
+	}
+
 	dec, err := reqdec.Download(req)
+	if isErrReqBodyTooLarge(err) {
+		return Reqdec{}, ErrPubRequestTooLarge(errors.Wrapf(
+			err, `request body exceeds the limit of %v bytes`, limit,
+		))
+	}
 	return Reqdec{dec}, ErrPubBadRequest(errors.WithStack(err))
 }
 
@@ -96,3 +114,139 @@ func (self JsonReqParams) HttpReqParams() (HttpReqParams, error) {
 		Body:   body,
 	}, nil
 }
+
+/*
+Short for "recording response writer". Wraps the response writer of each
+request, recording what was written, for the access log. The route pattern is
+recorded by handlers wrapped with `routed`, since "rout" doesn't expose it.
+
+Should be created by `reqWithRecRew` and retrieved with `ctxRecRew`.
+*/
+type RecRew struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+	Route  string
+
+	// Set by `writeErr` when an error occurs after the response headers were
+	// written, which means the client got an incomplete response with a
+	// misleading status.
+	LateErr error
+}
+
+func (self *RecRew) WriteHeader(status int) {
+	if self.Status == 0 {
+		self.Status = status
+	}
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *RecRew) Write(chunk []byte) (int, error) {
+	if self.Status == 0 {
+		self.Status = http.StatusOK
+	}
+	size, err := self.ResponseWriter.Write(chunk)
+	self.Bytes += int64(size)
+	return size, err
+}
+
+// Allows handlers to stream responses.
+func (self *RecRew) Flush() {
+	flusher, _ := self.ResponseWriter.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// Lets wrapping writers and middleware reach the underlying writer.
+func (self *RecRew) Unwrap() http.ResponseWriter { return self.ResponseWriter }
+
+// True if the response headers have been sent.
+func (self *RecRew) Wrote() bool { return self.Status != 0 }
+
+/*
+Discards the response, if nothing has been sent to the client yet, which
+allows to replace it. Returns true on success. See `CompressRew.Discard`.
+*/
+func (self *RecRew) Discard() bool {
+	discarder, _ := self.ResponseWriter.(interface{ Discard() bool })
+	if discarder == nil || !discarder.Discard() {
+		return false
+	}
+	self.Status = 0
+	self.Bytes = 0
+	return true
+}
+
+/*
+Status sent to the client. When the handler doesn't write anything, "net/http"
+implicitly responds with 200.
+*/
+func (self *RecRew) StatusCode() int {
+	if self.Status == 0 {
+		return http.StatusOK
+	}
+	return self.Status
+}
+
+/*
+Streams newline-delimited JSON: one value per line, flushed after each value.
+The function is called when the response is being written, with the request
+context and a function that writes one value. Values are never indented,
+regardless of `Conf.PrettyJson`, because each must fit on one line.
+
+The status and headers are sent with the first value. An error returned before
+that gets a regular error response. An error after that can only be logged,
+and the response ends abruptly; see `RecRew.LateErr`.
+
+When returned from a `resWithDbTx` handler, the function runs after the
+transaction has ended, and the context of the transaction is canceled. The
+function must not capture that context or the transaction. Instead, it should
+run queries via `withDbTx` with the context it receives, which starts a new
+transaction.
+
+`Conf.ServerWriteTimeout` limits the entire response, including the stream,
+and Go 1.16 provides no way to extend it for one request. Longer streams are
+cut off, and require raising or disabling the timeout.
+*/
+type NdjsonRes func(ctx Ctx, write func(interface{}) error) error
+
+func (self NdjsonRes) ServeHTTP(rew Rew, req *Req) {
+	var wrote bool
+
+	write := func(val interface{}) error {
+		bytes, err := json.Marshal(val)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if !wrote {
+			rew.Header().Set("content-type", MIME_TYPE_NDJSON)
+			wrote = true
+		}
+
+		_, err = rew.Write(append(bytes, '\n'))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		flusher, _ := rew.(http.Flusher)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	var err error
+	if self != nil {
+		err = self(req.Context(), write)
+	}
+
+	// An empty stream is still a valid response.
+	if err == nil && !wrote {
+		rew.Header().Set("content-type", MIME_TYPE_NDJSON)
+		rew.WriteHeader(http.StatusOK)
+	}
+
+	writeErr(rew, req, wrote, err)
+}
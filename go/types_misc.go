@@ -173,7 +173,10 @@ type DbCode string
 
 // Must be kept in sync with the conventions used by out schema, and with
 // `dbCodeRegexp`.
-const DbCodeErrorPrefix DbCode = "db.error."
+const (
+	DbCodeErrorPrefix      DbCode = "db.error."
+	DbCodeConstraintPrefix DbCode = "db.constraint."
+)
 
 // For app subcommands.
 type cmd struct{ fun func() error }
@@ -3,16 +3,30 @@ package main
 import (
 	"context"
 	"database/sql"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/mitranim/gos"
 	"github.com/mitranim/try"
 	"github.com/pkg/errors"
 )
 
+// Bounds of the exponential backoff between transaction retries. See
+// `withDbTxOpts`.
+const (
+	DB_TX_RETRY_DELAY_MIN = 10 * time.Millisecond
+	DB_TX_RETRY_DELAY_MAX = time.Second
+)
+
+// See `withDbSavepoint`. Rolling back to a savepoint should be nearly instant.
+const DB_SAVEPOINT_ROLLBACK_TIMEOUT = 5 * time.Second
+
 func dbQuery(ctx Ctx, conn DbConn, out interface{}, queryStr string, args []interface{}) error {
 	queryStr = formatSql(queryStr)
 	err := gos.Query(ctx, conn, out, queryStr, args)
@@ -41,6 +55,9 @@ func dbExec(ctx Ctx, conn DbConn, queryStr string, args []interface{}) error {
 	return decodeDbErr(err, queryStr)
 }
 
+// Matches lines such as `\ir file.pgsql` or `\gset`.
+var psqlMetaCommandRegexp = regexp.MustCompile(`(?m)^\s*\\[a-z]+`)
+
 func dbExecFile(ctx Ctx, conn DbConn, path string) error {
 	realPath, err := filepath.Abs(path)
 	if err != nil {
@@ -53,6 +70,9 @@ func dbExecFile(ctx Ctx, conn DbConn, path string) error {
 	}
 
 	queryStr := bytesToMutableString(content)
+	if psqlMetaCommandRegexp.MatchString(queryStr) {
+		return errors.Errorf(`%q contains psql meta-commands, which can only be executed by psql`, path)
+	}
 	queryStr = formatSql(queryStr)
 
 	_, err = conn.ExecContext(ctx, queryStr)
@@ -84,14 +104,38 @@ want to capture.
 var dbCodeRegexp = regexp.MustCompile(`"(db\.(?:constraint|error)(?:\.\w+)+)"\s*:?\s*(.*)`)
 
 /*
-TODO: consider supporting Postgres's common errors, including but not limited
-to:
+How we expose common Postgres errors. Errors caused by invalid inputs are made
+public, with an appropriate HTTP status. Transient errors remain private, but
+get a status that tells the client to retry.
 
-	* "null value in column A violates not-null constraint"
-	* "A violates check constraint B"
-	* etc.
+Reference: https://www.postgresql.org/docs/current/errcodes-appendix.html
+*/
+var pgErrSpecs = map[string]struct {
+	IsPublic   bool
+	HttpStatus int
+}{
+	POSTGRES_ERROR_CODE_CHECK_VIOLATION:              {true, http.StatusBadRequest},
+	POSTGRES_ERROR_CODE_NOT_NULL_VIOLATION:           {true, http.StatusBadRequest},
+	POSTGRES_ERROR_CODE_FOREIGN_KEY_VIOLATION:        {true, http.StatusBadRequest},
+	POSTGRES_ERROR_CODE_UNIQUE_VIOLATION:             {true, http.StatusConflict},
+	POSTGRES_ERROR_CODE_EXCLUSION_VIOLATION:          {true, http.StatusConflict},
+	POSTGRES_ERROR_CODE_STRING_DATA_RIGHT_TRUNCATION: {true, http.StatusBadRequest},
+	POSTGRES_ERROR_CODE_INVALID_TEXT_REPRESENTATION:  {true, http.StatusBadRequest},
+	POSTGRES_ERROR_CODE_SERIALIZATION_FAILURE:        {false, http.StatusServiceUnavailable},
+	POSTGRES_ERROR_CODE_DEADLOCK_DETECTED:            {false, http.StatusServiceUnavailable},
+}
+
+/*
+Matches the column list in the detail message of unique, exclusion and foreign
+key violations, such as:
+
+	Key (email)=(someone@example.com) already exists.
+	Key (person_id)=(123) is not present in table "persons".
+*/
+var pgErrDetailKeyRegexp = regexp.MustCompile(`^Key \((.+?)\)=`)
 
-Also, anonymous check constraints specified directly on columns aren't actually
+/*
+Anonymous check constraints specified directly on columns aren't actually
 anonymous; Postgres automatically gives them names using the following format:
 "<table_name>_<column_name>_<check>". We might consider supporting those.
 */
@@ -114,13 +158,30 @@ func decodeDbErr(err error, queryStr string) error {
 	if errors.As(err, &pgErr) {
 		err := Error{
 			Cause:     errors.WithStack(err),
-			IsPublic:  pgErr.Constraint != "" || pgErr.Code == POSTGRES_ERROR_CODE_CHECK_VIOLATION,
+			IsPublic:  pgErr.Constraint != "",
 			DbQuery:   pgErr.InternalQuery,
 			DbContext: strOr(pgErr.Where, pgErr.Hint),
+			DbTable:   pgErr.Table,
+			DbColumn:  pgErrColumn(pgErr),
+		}
+
+		spec, ok := pgErrSpecs[string(pgErr.Code)]
+		if ok {
+			err.IsPublic = err.IsPublic || spec.IsPublic
+			err.HttpStatus = spec.HttpStatus
+		}
+
+		// Referenced rows can't be deleted; this is a conflict rather than an
+		// invalid input.
+		if pgErr.Code == POSTGRES_ERROR_CODE_FOREIGN_KEY_VIOLATION &&
+			strings.Contains(pgErr.Detail, "is still referenced") {
+			err.HttpStatus = http.StatusConflict
 		}
 
 		if pgErr.Constraint != "" {
 			err.DbCode = DbCode(pgErr.Constraint)
+		} else if ok && spec.IsPublic {
+			err.DbCode = pgErrDbCode(pgErr)
 		}
 
 		if pgErr.Code == POSTGRES_ERROR_CODE_SYNTAX_ERROR && err.DbContext == "" {
@@ -147,6 +208,26 @@ func decodeDbErr(err error, queryStr string) error {
 	return errors.WithStack(err)
 }
 
+// Generic code for the Postgres error, such as "db.error.unique_violation".
+func pgErrDbCode(pgErr PgErr) DbCode {
+	return DbCodeErrorPrefix + DbCode(pgErr.Code.Name())
+}
+
+/*
+Postgres reports the column only for some errors, such as not-null violations.
+For others, we try to extract it from the detail message.
+*/
+func pgErrColumn(pgErr PgErr) string {
+	if pgErr.Column != "" {
+		return pgErr.Column
+	}
+	match := pgErrDetailKeyRegexp.FindStringSubmatch(pgErr.Detail)
+	if len(match) > 0 {
+		return match[1]
+	}
+	return ""
+}
+
 /*
 Reformats an SQL query from multi-line to single-line for compatibility with
 logging systems such as Stackdriver which expect strictly single-line messages.
@@ -170,8 +251,63 @@ committed or aborted here, depending on whether the function returns an error.
 Storing a transaction in the context is used mainly for testing. Tests run in a
 transaction that is rolled back at the end. Supporting this here makes it
 automatic for practically all our code.
+
+An error in a reused transaction aborts it as a whole. To recover from an error
+and keep using the outer transaction, for example to attempt an insert and fall
+back on something else, use `withDbSavepoint`.
 */
-func withDbTx(ctx Ctx, fun func(Ctx, DbTx) error) (err error) {
+func withDbTx(ctx Ctx, fun func(Ctx, DbTx) error) error {
+	return withDbTxOpts(ctx, DbTxOpts{}, fun)
+}
+
+/*
+Same as `withDbTx`, but with custom options for the created transaction. The
+options are ignored for a transaction retrieved from the context, except for
+`DbTxOpts.Savepoint`. Read-only transactions may run on the read replica; see
+`dbForTx`.
+
+When `DbTxOpts.MaxAttempts` allows, failures caused by serialization conflicts
+or deadlocks are retried in a fresh transaction, after a jittered exponential
+backoff. This requires the function to be safe to re-run: it must not have
+side effects outside the transaction. Retries are never performed for a
+transaction from the context, because it belongs to the caller (usually a test
+or an outer `withDbTx`), and is already aborted by the failure.
+*/
+func withDbTxOpts(ctx Ctx, opts DbTxOpts, fun func(Ctx, DbTx) error) error {
+	if opts.MaxAttempts <= 1 || ctxDbTx(ctx) != nil {
+		return withDbTxAttempt(ctx, opts, fun)
+	}
+
+	delay := DB_TX_RETRY_DELAY_MIN
+	for attempt := 1; ; attempt++ {
+		err := withDbTxAttempt(ctx, opts, fun)
+		if err == nil || !isErrDbRetryable(err) || attempt >= opts.MaxAttempts {
+			return err
+		}
+
+		// "Equal jitter": at least half of the delay, which prevents conflicting
+		// transactions from retrying in lockstep.
+		wait := delay/2 + time.Duration(env.rand.Int63n(int64(delay/2)+1))
+
+		code := pgErrCode(err)
+		env.metrics.DbTxRetry(code)
+		ctxLog(ctx).Warnw("retrying DB transaction",
+			"attempt", attempt, "maxAttempts", opts.MaxAttempts, "code", code, "delay", wait)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+
+		delay *= 2
+		if delay > DB_TX_RETRY_DELAY_MAX {
+			delay = DB_TX_RETRY_DELAY_MAX
+		}
+	}
+}
+
+func withDbTxAttempt(ctx Ctx, opts DbTxOpts, fun func(Ctx, DbTx) error) (err error) {
 	defer try.Rec(&err)
 
 	if fun == nil {
@@ -180,30 +316,103 @@ func withDbTx(ctx Ctx, fun func(Ctx, DbTx) error) (err error) {
 
 	tx := ctxDbTx(ctx)
 	if tx != nil {
+		if opts.Savepoint {
+			return withDbTxSavepoint(ctx, tx, fun)
+		}
 		return fun(ctx, tx)
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	ctx, tx, err = beginTxCtx(ctx, env.db)
+	db := dbForTx(opts)
+	ctx, tx, err = beginTxCtxOpts(ctx, db, opts)
+	// Other errors, such as in "set local", would occur on the primary too.
+	if err != nil && db != env.db && ctx.Err() == nil && isErrDbUnreachable(err) {
+		setDbReplicaUp(err)
+		ctx, tx, err = beginTxCtxOpts(ctx, env.db, opts)
+	}
 	if err != nil {
 		return err
 	}
 
+	// Uncommitted transactions are rolled back by the context cancelation.
+	var committed bool
+	defer func() { env.metrics.DbTx(committed) }()
+
 	err = fun(ctx, tx)
 	if err != nil {
 		return err
 	}
 
 	err = tx.Commit()
+	committed = err == nil
 	return errors.Wrap(err, `failed to commit transaction`)
 }
 
+/*
+Same as `withDbTx`, but when the transaction is retrieved from the context, the
+function runs within a savepoint. On error, the changes made by the function
+are rolled back, and the outer transaction remains usable. On success, the
+savepoint is released, and the changes become part of the outer transaction.
+
+The rollback to the savepoint ignores the cancelation of the context, for
+example when the client disconnects, since the outer transaction may outlive
+it. However, when the outer transaction was started with a canceled context,
+"database/sql" has already rolled it back, and it's unusable regardless.
+*/
+func withDbSavepoint(ctx Ctx, fun func(Ctx, DbTx) error) error {
+	return withDbTxOpts(ctx, DbTxOpts{Savepoint: true}, fun)
+}
+
+// Savepoint names only need to be unique among nested savepoints.
+var dbSavepointCounter uint64
+
+func withDbTxSavepoint(ctx Ctx, tx DbTx, fun func(Ctx, DbTx) error) (err error) {
+	name := `savepoint_` + strconv.FormatUint(atomic.AddUint64(&dbSavepointCounter, 1), 10)
+
+	err = dbExec(ctx, tx, `savepoint `+name, nil)
+	if err != nil {
+		return errors.Wrap(err, `failed to create savepoint`)
+	}
+
+	/**
+	Keeps the original error, which callers may want to inspect. A failure to roll
+	back leaves the outer transaction aborted, which is reported by its next
+	query anyway.
+	*/
+	defer func() {
+		if err != nil {
+			rollbackCtx, cancel := context.WithTimeout(context.Background(), DB_SAVEPOINT_ROLLBACK_TIMEOUT)
+			defer cancel()
+
+			rollbackErr := dbExec(rollbackCtx, tx, `rollback to savepoint `+name, nil)
+			if rollbackErr != nil {
+				logErrorCtx(ctx, errors.Wrap(rollbackErr, `failed to roll back to savepoint`))
+			}
+		}
+	}()
+
+	// Must run before the rollback, converting panics into errors.
+	defer try.Rec(&err)
+
+	err = fun(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	err = dbExec(ctx, tx, `release savepoint `+name, nil)
+	return errors.Wrap(err, `failed to release savepoint`)
+}
+
 func withReqDbTx(req *Req, fun func(Ctx, DbTx) error) error {
 	return withDbTx(req.Context(), fun)
 }
 
+func withReqDbTxOpts(req *Req, opts DbTxOpts, fun func(Ctx, DbTx) error) error {
+	return withDbTxOpts(req.Context(), opts, fun)
+}
+
 func ctxDbTx(ctx Ctx) DbTx {
 	tx, _ := ctx.Value(CTX_DB_TX_KEY).(DbTx)
 	return tx
@@ -222,3 +431,31 @@ func beginTx(ctx Ctx, db DbTxer) (DbTx, error) {
 	conn, err := db.BeginTx(ctx, DEFAULT_DB_TX_OPTIONS)
 	return conn, errors.Wrap(err, `failed to start DB transaction`)
 }
+
+func beginTxCtxOpts(ctx Ctx, db DbTxer, opts DbTxOpts) (Ctx, DbTx, error) {
+	tx, err := beginTxOpts(ctx, db, opts)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctxWithDbTx(ctx, tx), tx, nil
+}
+
+/*
+Starts a transaction with the given isolation level and access mode, then
+applies the timeouts. On failure, the transaction is rolled back.
+*/
+func beginTxOpts(ctx Ctx, db DbTxer, opts DbTxOpts) (DbTx, error) {
+	tx, err := db.BeginTx(ctx, opts.TxOptions())
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to start DB transaction`)
+	}
+
+	for _, query := range opts.SetLocalQueries() {
+		err = dbExec(ctx, tx, query, nil)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"io"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"os"
@@ -17,11 +19,27 @@ import (
 // https://www.postgresql.org/docs/current/errcodes-appendix.html
 // https://www.postgresql.org/docs/12/errcodes-appendix.html
 const (
-	POSTGRES_ERROR_CODE_QUERY_CANCELED  = "57014"
-	POSTGRES_ERROR_CODE_SYNTAX_ERROR    = "42601"
-	POSTGRES_ERROR_CODE_CHECK_VIOLATION = "23514"
+	POSTGRES_ERROR_CODE_QUERY_CANCELED               = "57014"
+	POSTGRES_ERROR_CODE_SYNTAX_ERROR                 = "42601"
+	POSTGRES_ERROR_CODE_CHECK_VIOLATION              = "23514"
+	POSTGRES_ERROR_CODE_NOT_NULL_VIOLATION           = "23502"
+	POSTGRES_ERROR_CODE_FOREIGN_KEY_VIOLATION        = "23503"
+	POSTGRES_ERROR_CODE_UNIQUE_VIOLATION             = "23505"
+	POSTGRES_ERROR_CODE_EXCLUSION_VIOLATION          = "23P01"
+	POSTGRES_ERROR_CODE_STRING_DATA_RIGHT_TRUNCATION = "22001"
+	POSTGRES_ERROR_CODE_INVALID_TEXT_REPRESENTATION  = "22P02"
+	POSTGRES_ERROR_CODE_SERIALIZATION_FAILURE        = "40001"
+	POSTGRES_ERROR_CODE_DEADLOCK_DETECTED            = "40P01"
+	POSTGRES_ERROR_CODE_CANNOT_CONNECT_NOW           = "57P03"
 )
 
+/*
+Non-standard status popularized by Nginx. Used when the client has disconnected
+before we could respond. The response is never seen by the client; the status
+is meaningful only for logging.
+*/
+const HTTP_STATUS_CLIENT_CLOSED_REQUEST = 499
+
 /*
 Wraps the input in `Error`, if necessary. If the input is already an `Error`,
 it's returned as-is.
@@ -56,6 +74,18 @@ func ErrWith(err error, fun func(*Error)) error {
 	return out
 }
 
+/*
+Converts a recovered panic value to an error with a stack trace. When called
+by the deferred function that recovered, the trace includes the panic site.
+*/
+func errPanic(val interface{}) error {
+	err, _ := val.(error)
+	if err != nil {
+		return Err(errors.Wrap(err, `recovered panic`))
+	}
+	return Err(errors.Errorf(`recovered panic: %v`, val))
+}
+
 func ErrPub(err error) error {
 	return ErrWith(err, func(err *Error) { err.IsPublic = true })
 }
@@ -79,6 +109,8 @@ func ErrPubUnauthenticated(err error) error { return ErrPubHttp(err, http.Status
 
 func ErrPubForbidden(err error) error { return ErrPubHttp(err, http.StatusForbidden) }
 
+func ErrPubRequestTooLarge(err error) error { return ErrPubHttp(err, http.StatusRequestEntityTooLarge) }
+
 // Can be used to expose the error message to the client.
 func ErrPubInternal(err error) error { return ErrPubHttp(err, http.StatusInternalServerError) }
 
@@ -179,6 +211,65 @@ func isErrNetDeadlineExceeded(err error) bool {
 		errors.Is(err, os.ErrDeadlineExceeded)
 }
 
+/*
+The error returned by `http.MaxBytesReader` is not exported in the Go version
+we target, so we have to match the message. Also detects the multipart
+equivalent.
+*/
+func isErrReqBodyTooLarge(err error) bool {
+	return errors.Is(err, multipart.ErrMessageTooLarge) ||
+		(err != nil && strings.Contains(err.Error(), "request body too large"))
+}
+
+/*
+Also detects Postgres statement timeouts. Postgres uses the same code for
+statement timeouts and for cancellation; we tell them apart by checking whether
+our own context was canceled.
+*/
+func isErrTimeout(ctx Ctx, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) ||
+		(ctx != nil && errors.Is(ctx.Err(), context.DeadlineExceeded)) ||
+		(isPgErrWithCode(err, POSTGRES_ERROR_CODE_QUERY_CANCELED) && !(ctx != nil && isCtxCanceled(ctx)))
+}
+
+/*
+Transient transaction failures that are expected to succeed when retried in a
+new transaction.
+*/
+func isErrDbRetryable(err error) bool {
+	return isPgErrWithCode(err, POSTGRES_ERROR_CODE_SERIALIZATION_FAILURE) ||
+		isPgErrWithCode(err, POSTGRES_ERROR_CODE_DEADLOCK_DETECTED)
+}
+
+// Returns the Postgres error code, or "" for other errors.
+func pgErrCode(err error) string {
+	var pgErr PgErr
+	if errors.As(err, &pgErr) {
+		return string(pgErr.Code)
+	}
+	return ""
+}
+
+/*
+True for errors that may go away when the DB becomes reachable: network errors,
+connections closed by the DB, and the DB refusing connections while starting
+up. Other errors, such as bad credentials or SSL misconfiguration, are false.
+*/
+func isErrDbUnreachable(err error) bool {
+	var pgErr PgErr
+	if errors.As(err, &pgErr) {
+		return string(pgErr.Code) == POSTGRES_ERROR_CODE_CANNOT_CONNECT_NOW
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
 // Helps avoid confusion by using consistent terms.
 func isErrUnauthenticated(err error) bool {
 	return isErrWithHttpStatus(err, http.StatusUnauthorized)
@@ -219,6 +310,33 @@ func shouldLogError(ctx Ctx, err error) bool {
 	return true
 }
 
+/*
+Guesses the appropriate HTTP status for an error, without regard for whether
+the error is public. Used for non-public errors whose messages are hidden, but
+whose statuses may still be informative to clients and monitoring.
+
+499 requires the context to be canceled. Cancellation errors that happen while
+the request is still alive are bugs, and are reported as such.
+*/
+func errHttpStatus(ctx Ctx, err error) int {
+	switch {
+	case isErrTimeout(ctx, err):
+		return http.StatusGatewayTimeout
+	case ctx != nil && isCtxCanceled(ctx) && isErrPossiblyCancelRelated(err):
+		return HTTP_STATUS_CLIENT_CLOSED_REQUEST
+	case isErrNotFound(err):
+		return http.StatusNotFound
+	case isErrDbRetryable(err):
+		return http.StatusServiceUnavailable
+	}
+
+	var unwrapped Error
+	if errors.As(err, &unwrapped) {
+		return unwrapped.HttpStatusCode()
+	}
+	return http.StatusInternalServerError
+}
+
 /*
 "Normalizes" errors by converting known types to `Error`, when possible.
 Database errors are handled separately by `decodeDbErr`.
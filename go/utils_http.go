@@ -2,6 +2,12 @@ package main
 
 import (
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 const (
@@ -14,30 +20,267 @@ const (
 	OPTIONS = http.MethodOptions
 )
 
+const (
+	MIME_TYPE_TEXT         = "text/plain"
+	MIME_TYPE_JSON         = "application/json"
+	MIME_TYPE_PROBLEM_JSON = "application/problem+json"
+	MIME_TYPE_NDJSON       = "application/x-ndjson"
+)
+
 func isHttpStatusOk(statusCode int) bool {
 	return statusCode >= 200 && statusCode <= 299
 }
 
+// Zero means the status hasn't been written yet, and will default to 200.
+func httpStatusAllowsBody(statusCode int) bool {
+	return !(statusCode >= 100 && statusCode <= 199 ||
+		statusCode == http.StatusNoContent ||
+		statusCode == http.StatusNotModified)
+}
+
+// Adds a "vary" value, unless already present.
+func addVary(header http.Header, val string) {
+	for _, existing := range header.Values("vary") {
+		for _, part := range strings.Split(existing, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), val) {
+				return
+			}
+		}
+	}
+	header.Add("vary", val)
+}
+
+// Inverse of `addVary`. Preserves other values.
+func delVary(header http.Header, val string) {
+	var out []string
+	for _, existing := range header.Values("vary") {
+		for _, part := range strings.Split(existing, ",") {
+			part = strings.TrimSpace(part)
+			if part != "" && !strings.EqualFold(part, val) {
+				out = append(out, part)
+			}
+		}
+	}
+
+	header.Del("vary")
+	for _, part := range out {
+		header.Add("vary", part)
+	}
+}
+
+/*
+Used by default for API responses and errors. Handlers may override it with
+`setCacheControl`.
+*/
 func preventCaching(header http.Header) {
-	header.Add("cache-control", "must-revalidate")
-	header.Add("cache-control", "no-cache")
-	header.Add("cache-control", "no-store")
-	header.Add("cache-control", "proxy-revalidate")
-	header.Add("cache-control", "max-age=0")
-	header.Add("expires", "0")
+	setCacheControl(header, "no-store, no-cache, must-revalidate, proxy-revalidate, max-age=0")
+	header.Set("expires", "0")
+}
+
+// Replaces any previously set caching policy.
+func setCacheControl(header http.Header, val string) {
+	header.Del("expires")
+	header.Set("cache-control", val)
 }
 
 /*
-Reference: https://www.w3.org/TR/cors/.
+Adds CORS headers according to `Conf.Cors*`. The allowed origin is reflected
+rather than "*", which browsers reject in combination with credentials.
+Returns false if the request comes from an origin that is not allowed, in which
+case no CORS headers are added and the browser blocks the response.
+
+Reference: https://fetch.spec.whatwg.org/#http-cors-protocol.
 */
-func allowCors(header http.Header) {
-	header.Add("access-control-allow-credentials", "true")
-	header.Add("access-control-allow-headers", "content-type")
-	header.Add("access-control-allow-methods", "OPTIONS, GET, HEAD, POST, PUT, PATCH, DELETE")
-	header.Add("access-control-allow-origin", "*")
+func allowCors(header http.Header, req *Req) bool {
+	// The response depends on the origin, whether or not it's allowed.
+	header.Add("vary", "origin")
+
+	origin := req.Header.Get("origin")
+	if origin == "" {
+		return true
+	}
+	if !isCorsOriginAllowed(origin) {
+		return false
+	}
+
+	conf := env.conf
+	header.Set("access-control-allow-origin", origin)
+	if conf.CorsCredentials {
+		header.Set("access-control-allow-credentials", "true")
+	}
+	if len(conf.CorsExposeHeaders) > 0 {
+		header.Set("access-control-expose-headers", strings.Join(conf.CorsExposeHeaders, ", "))
+	}
+
+	if isCorsPreflight(req) {
+		header.Add("vary", "access-control-request-method")
+		header.Add("vary", "access-control-request-headers")
+		header.Set("access-control-allow-methods", strings.Join(conf.CorsMethods, ", "))
+		header.Set("access-control-allow-headers", strings.Join(conf.CorsHeaders, ", "))
+		if conf.CorsMaxAge > 0 {
+			header.Set("access-control-max-age", intToString(int64(conf.CorsMaxAge/time.Second)))
+		}
+	}
+	return true
 }
 
-var jsonResHeader = httpHead("content-type", "application/json")
+func isCorsPreflight(req *Req) bool {
+	return req.Method == OPTIONS &&
+		req.Header.Get("origin") != "" &&
+		req.Header.Get("access-control-request-method") != ""
+}
+
+func isCorsOriginAllowed(origin string) bool {
+	for _, pattern := range env.conf.CorsOrigins {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		ok, _ := path.Match(pattern, origin)
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Invalid patterns would be silently ignored by `isCorsOriginAllowed`. Reflecting
+any origin with credentials would let every site make authenticated requests,
+so "*" is rejected when `Conf.CorsCredentials` is set.
+*/
+func validateCorsOrigins() error {
+	for _, pattern := range env.conf.CorsOrigins {
+		if pattern == "*" && env.conf.CorsCredentials {
+			return errors.New(`CORS_ORIGINS must not contain "*" when CORS_CREDENTIALS is enabled`)
+		}
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return errors.Wrapf(err, `invalid CORS origin pattern %q`, pattern)
+		}
+	}
+	return nil
+}
+
+/*
+True if the "accept-encoding" header allows the given content coding, either
+explicitly or via "*", with a non-zero quality.
+*/
+func acceptsEncoding(header http.Header, coding string) bool {
+	var wildcard bool
+	for _, item := range parseAcceptHeader(header, "accept-encoding") {
+		if strings.EqualFold(item.Value, coding) {
+			return item.Quality > 0
+		}
+		if item.Value == "*" {
+			wildcard = item.Quality > 0
+		}
+	}
+	return wildcard
+}
+
+// Element of an "accept"-style header, such as "text/html;q=0.9".
+type AcceptItem struct {
+	Value   string
+	Quality float64
+}
+
+/*
+Parses "accept", "accept-encoding", "accept-language" and similar headers:
+comma-separated values with optional parameters, where "q" is the quality
+between 0 and 1, defaulting to 1. Combines multiple header lines, and returns
+the values in the header order. Values are lowercased, since all of these are
+case-insensitive. Other parameters are dropped, and values with a malformed
+quality are skipped.
+*/
+func parseAcceptHeader(header http.Header, key string) []AcceptItem {
+	var out []AcceptItem
+
+outer:
+	for _, part := range strings.Split(strings.Join(header.Values(key), ","), ",") {
+		params := strings.Split(part, ";")
+		item := AcceptItem{Value: strings.ToLower(strings.TrimSpace(params[0])), Quality: 1}
+		if item.Value == "" {
+			continue
+		}
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) < 2 || !strings.EqualFold(param[:2], "q=") {
+				continue
+			}
+			val, err := strconv.ParseFloat(strings.TrimSpace(param[2:]), 64)
+			if err != nil {
+				continue outer
+			}
+			item.Quality = val
+		}
+
+		out = append(out, item)
+	}
+	return out
+}
+
+var jsonResHeader = httpHead("content-type", MIME_TYPE_JSON)
+
+/*
+Chooses the offered media type most preferred by the "accept" header. Ties are
+resolved in favor of earlier offers. When the header is missing, returns the
+first offer. When none of the offers are acceptable, returns "".
+
+Supports wildcard media ranges and the "q" parameter. Other media type
+parameters are ignored.
+*/
+func negotiateMediaType(header http.Header, offers ...string) string {
+	accept := parseAcceptHeader(header, "accept")
+	if len(accept) == 0 {
+		if len(offers) > 0 {
+			return offers[0]
+		}
+		return ""
+	}
+
+	var out string
+	var outQuality float64
+	for _, offer := range offers {
+		quality := acceptQuality(accept, offer)
+		if quality > outQuality {
+			out, outQuality = offer, quality
+		}
+	}
+	return out
+}
+
+/*
+Quality of the given media type according to the "accept" header, between 0
+and 1. Uses the most specific matching media range.
+*/
+func acceptQuality(accept []AcceptItem, mediaType string) float64 {
+	var quality float64
+	specificity := -1
+
+	for _, item := range accept {
+		spec := mediaRangeSpecificity(item.Value, mediaType)
+		if spec > specificity {
+			quality, specificity = item.Quality, spec
+		}
+	}
+	return quality
+}
+
+// Returns -1 if the media range doesn't match the media type.
+func mediaRangeSpecificity(mediaRange string, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 2
+	case mediaRange == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange, "/*") &&
+		strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 1
+	default:
+		return -1
+	}
+}
 
 func patchHttpHeader(left http.Header, right http.Header) http.Header {
 	out := http.Header{}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
 /*
 Unlike the logger methods `.Error` and `.Errorw`, this prints TWO stacktraces:
 where the error was created (if possible), and where the error was logged.
@@ -14,8 +20,65 @@ func logError(err error) {
 	}
 }
 
+// Same as `logError`, but uses the request-scoped logger when available.
+func logErrorCtx(ctx Ctx, err error) {
+	if err != nil {
+		ctxLog(ctx).Errorf("%+v", err)
+	}
+}
+
 func maybeLogError(ctx Ctx, err error) {
 	if shouldLogError(ctx, err) {
-		logError(err)
+		logErrorCtx(ctx, err)
 	}
 }
+
+/*
+Returns the request-scoped logger stored by `reqWithReqId`, which includes the
+request ID in every line, falling back on the global logger.
+*/
+func ctxLog(ctx Ctx) *zap.SugaredLogger {
+	if ctx != nil {
+		log, _ := ctx.Value(CTX_LOG_KEY).(*zap.SugaredLogger)
+		if log != nil {
+			return log
+		}
+	}
+	return env.log
+}
+
+/*
+Emits one structured line per request, unless the path is excluded via
+`Conf.AccessLogExclude` or the request is skipped by sampling. Server errors
+and late errors (see `RecRew.LateErr`) bypass sampling.
+*/
+func logAccess(req *Req, rec *RecRew, start time.Time) {
+	status := rec.StatusCode()
+
+	for _, path := range env.conf.AccessLogExclude {
+		if req.URL.Path == path {
+			return
+		}
+	}
+
+	important := status >= 500 || rec.LateErr != nil
+	if !important && env.rand.Float64() >= env.conf.AccessLogSampleRate {
+		return
+	}
+
+	fields := []interface{}{
+		"method", req.Method,
+		"path", req.URL.Path,
+		"route", rec.Route,
+		"status", status,
+		"bytes", rec.Bytes,
+		"duration", time.Since(start),
+		"remoteAddr", req.RemoteAddr,
+		"userAgent", req.UserAgent(),
+	}
+	if rec.LateErr != nil {
+		fields = append(fields, "lateError", rec.LateErr.Error())
+	}
+
+	ctxLog(req.Context()).Infow("request", fields...)
+}
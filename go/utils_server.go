@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/mitranim/goh"
+	"github.com/mitranim/rout"
 	"github.com/mitranim/try"
 )
 
@@ -38,6 +42,145 @@ func reqWithReqCtx(req *Req) *Req {
 	return req.WithContext(ctx)
 }
 
+/*
+Assigns a request ID, reusing the incoming "x-request-id" when it looks sane,
+echoes it in the response header, and stores it in the request context along
+with a child logger that includes it. They can be retrieved with `ctxReqId`
+and `ctxLog`.
+*/
+func reqWithReqId(rew Rew, req *Req) *Req {
+	if req == nil {
+		return nil
+	}
+
+	id := req.Header.Get(REQ_ID_HEADER)
+	if !isValidReqId(id) {
+		id = randomReqId()
+	}
+	rew.Header().Set(REQ_ID_HEADER, id)
+
+	ctx := context.WithValue(req.Context(), CTX_REQ_ID_KEY, id)
+	ctx = context.WithValue(ctx, CTX_LOG_KEY, env.log.With("requestId", id))
+	return req.WithContext(ctx)
+}
+
+// Should be used after `reqWithReqId`.
+func ctxReqId(ctx Ctx) string {
+	if ctx != nil {
+		id, _ := ctx.Value(CTX_REQ_ID_KEY).(string)
+		return id
+	}
+	return ""
+}
+
+/*
+Incoming request IDs end up in our logs and response headers, so we accept only
+short strings of "safe" characters.
+*/
+func isValidReqId(id string) bool {
+	if id == "" || len(id) > REQ_ID_MAX_LEN {
+		return false
+	}
+	for _, char := range id {
+		if !(char >= 'a' && char <= 'z' ||
+			char >= 'A' && char <= 'Z' ||
+			char >= '0' && char <= '9' ||
+			strings.ContainsRune("-_.:", char)) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Note: `env.rand` is not safe for concurrent use, and request IDs are generated
+concurrently, so we use "crypto/rand".
+*/
+func randomReqId() string {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	try.To(err)
+	return hex.EncodeToString(buf[:])
+}
+
+/*
+Stores the recording response writer in the request context. It can be
+retrieved with `ctxRecRew`.
+*/
+func reqWithRecRew(req *Req, rew *RecRew) *Req {
+	if req == nil {
+		return nil
+	}
+	ctx := context.WithValue(req.Context(), CTX_REC_REW_KEY, rew)
+	return req.WithContext(ctx)
+}
+
+// Should be used after `reqWithRecRew`.
+func ctxRecRew(ctx Ctx) *RecRew {
+	if ctx != nil {
+		rew, _ := ctx.Value(CTX_REC_REW_KEY).(*RecRew)
+		return rew
+	}
+	return nil
+}
+
+/*
+Wraps a route handler, recording the route pattern for the access log. Returns
+the pattern too, which allows to pass the result directly to a router method:
+
+	r.Get(routed(`^/api/v1$`, apiHealthCheck))
+
+Also recovers from panics in the handler. "rout" would convert them to errors
+anyway, but without a trace of the panic site.
+*/
+func routed(pattern string, fun rout.Func) (string, rout.Func) {
+	return pattern, func(rew Rew, req *Req) {
+		rec := ctxRecRew(req.Context())
+		if rec != nil {
+			rec.Route = pattern
+		}
+		defer recWriteErr(rew, req)
+		fun(rew, req)
+	}
+}
+
+/*
+Must be deferred. Recovers from a panic, converting it to an error with a stack
+trace, then logs it and writes the error response via `writeErr`. Without this,
+"net/http" would log the panic to stderr and drop the connection.
+
+Doesn't recover from `http.ErrAbortHandler`, which is used to deliberately
+abort a response. Handlers reach this only through `routeRequest`, because
+"rout" recovers from their panics.
+*/
+func recWriteErr(rew Rew, req *Req) {
+	val := recover()
+	if val == nil {
+		return
+	}
+	if val == http.ErrAbortHandler {
+		panic(val)
+	}
+	writeErr(rew, req, false, errPanic(val))
+}
+
+// Records the finished request in the metrics and the access log.
+func finishRequest(req *Req, rec *RecRew, start time.Time) {
+	env.metrics.HttpEnd(req.Method, rec.Route, rec.StatusCode(), time.Since(start))
+	logAccess(req, rec, start)
+}
+
+/*
+Caps the request body at `Conf.ServerMaxBodySize`. Must be called before reading
+the body. Reading past the limit produces an error detected by
+`isErrReqBodyTooLarge`.
+*/
+func limitReqBody(rew Rew, req *Req) {
+	if env.conf.ServerMaxBodySize > 0 && req.Body != nil {
+		req.Body = http.MaxBytesReader(rew, req.Body, env.conf.ServerMaxBodySize)
+	}
+}
+
 func reqDownloadDecode(req *Req, out interface{}) error {
 	// Automatically uses `ErrPubBadRequest` when appropriate.
 	dec, err := DownloadReqdec(req)
@@ -82,15 +225,23 @@ transaction. If the DB transaction fails to commit, we ignore the handler's
 response and send the commit error.
 */
 func resWithDbTx(rew Rew, req *Req, fun func(Ctx, DbTx) (Res, error)) {
+	resWithDbTxOpts(rew, req, DbTxOpts{}, fun)
+}
+
+/*
+Same as `resWithDbTx`, but with custom transaction options, such as isolation
+level and timeouts. See `DbTxOpts`.
+*/
+func resWithDbTxOpts(rew Rew, req *Req, opts DbTxOpts, fun func(Ctx, DbTx) (Res, error)) {
 	var res Res
 	var err error
 
 	/**
-	Note: we must use the error returned by `withReqDbTx` rather than just the
-	error returned by `fun` because `withReqDbTx` may fail to commit the DB
-	transaction.
+	Note: we must use the error returned by `withReqDbTxOpts` rather than just
+	the error returned by `fun` because `withReqDbTxOpts` may fail to commit the
+	DB transaction.
 	*/
-	err = withReqDbTx(req, func(ctx Ctx, conn DbTx) error {
+	err = withReqDbTxOpts(req, opts, func(ctx Ctx, conn DbTx) error {
 		res, err = fun(ctx, conn)
 		return err
 	})
@@ -98,6 +249,72 @@ func resWithDbTx(rew Rew, req *Req, fun func(Ctx, DbTx) (Res, error)) {
 	writeResOrErr(rew, req, res, err)
 }
 
+// Shortcut for `resJsonWith(http.StatusOK, body)`.
+func resJson(body interface{}) (Res, error) {
+	return resJsonWith(http.StatusOK, body)
+}
+
+/*
+Encodes the body via `jsonMarshal`, which honors `Conf.PrettyJson`. Unlike
+`goh.Json`, this encodes before sending anything, and encoding errors are
+returned to the caller. Meant for handlers used with `resWith` or
+`resWithDbTx`:
+
+	func apiFeed(rew Rew, req *Req) {
+		resWithDbTxOpts(rew, req, DbTxOpts{ReadOnly: true}, func(ctx Ctx, conn DbTx) (Res, error) {
+			feed, err := dbFeed(ctx, conn)
+			if err != nil {
+				return nil, err
+			}
+			return resJson(feed)
+		})
+	}
+*/
+func resJsonWith(status int, body interface{}) (Res, error) {
+	bytes, err := jsonMarshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return goh.Bytes{Status: status, Header: jsonResHeader, Body: bytes}, nil
+}
+
+/*
+Responds with 201 and the "location" of the created resource. The body is
+optional; nil means no body.
+*/
+func resCreated(location string, body interface{}) (Res, error) {
+	header := httpHead("location", location)
+	if body == nil {
+		return goh.Bytes{Status: http.StatusCreated, Header: header}, nil
+	}
+
+	bytes, err := jsonMarshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return goh.Bytes{
+		Status: http.StatusCreated,
+		Header: patchHttpHeader(jsonResHeader, header),
+		Body:   bytes,
+	}, nil
+}
+
+func resNoContent() Res {
+	return goh.Bytes{Status: http.StatusNoContent}
+}
+
+/*
+Note: we avoid `goh.Redirect`, which writes the status twice.
+*/
+func resRedirect(status int, link string) Res {
+	return http.RedirectHandler(link, status)
+}
+
+// Shortcut for converting a function to `NdjsonRes`. See its comment.
+func resNdjson(fun func(ctx Ctx, write func(interface{}) error) error) Res {
+	return NdjsonRes(fun)
+}
+
 func writeRes(rew Rew, req *Req, res Res) {
 	if res != nil {
 		res.ServeHTTP(rew, req)
@@ -105,11 +322,17 @@ func writeRes(rew Rew, req *Req, res Res) {
 }
 
 /*
-TODO: consider choosing error encoding based on the requested content type. For
-plain text, we continue returning the error's text. For JSON, we might encode
-the error as JSON for easy programmatic inspection; an `Error` may be encoded
-as-is; for other errors we should define something similarly-structured but
-opaque. For HTML, we might render a special HTML error page.
+Logs the error if appropriate, then sends an error response, unless the
+response has already been written to. In the latter case, the request is
+flagged in the access log.
+
+The error encoding is chosen based on the "accept" header. Clients accepting
+JSON get `ErrRes`, or `ProblemRes` when `Conf.ProblemJson` is set or the client
+explicitly asks for "application/problem+json". Other clients get plain text.
+Non-public errors are hidden either way. Messages of public DB errors are
+localized via `DbMessages`.
+
+TODO: for HTML, we might render a special HTML error page.
 */
 func writeErr(rew Rew, req *Req, wrote bool, err error) {
 	if err == nil {
@@ -121,21 +344,85 @@ func writeErr(rew Rew, req *Req, wrote bool, err error) {
 		maybeLogError(req.Context(), err)
 	}
 
+	/**
+	The handler may have written the headers without telling us. Writing the
+	error response would make "net/http" complain about a superfluous
+	`.WriteHeader` call and corrupt the body, so we only flag the request.
+	However, if the response is still buffered (see `CompressRew`), we can
+	discard it and send the error instead.
+	*/
+	rec := ctxRecRew(req.Context())
+	if rec != nil && rec.Wrote() {
+		wrote = true
+	}
+
 	if wrote {
-		return
+		if rec == nil || !rec.Discard() {
+			if rec != nil {
+				rec.LateErr = err
+			}
+			return
+		}
 	}
 
-	pub, ok := errPub(err).(Error)
-	if ok {
-		writeRes(rew, req, goh.StringWith(pub.HttpStatusCode(), pub.Error()))
-		return
+	body := ErrResFrom(req.Context(), err)
+	env.metrics.Err(body.DbCode, body.HttpStatus)
+
+	// Overrides the caching policy of the route, if any.
+	preventCaching(rew.Header())
+
+	writeRes(rew, req, errRes(req, err, body))
+}
+
+// The body must come from `ErrResFrom`.
+func errRes(req *Req, err error, body ErrRes) Res {
+	body.RequestId = ctxReqId(req.Context())
+	header := errResHeader(body.HttpStatus)
+
+	locale := body.Localize(req, err)
+	if locale != "" {
+		header = patchHttpHeader(header, httpHead("content-language", locale))
 	}
 
-	/**
-	TODO: consider auto-detecting the HTTP status code here, despite hiding the
-	error message. For example, we could use `isErrNotFound` to detect 404.
-	*/
-	writeRes(rew, req, goh.StringWith(http.StatusInternalServerError, `Unexpected Error`))
+	switch negotiateMediaType(req.Header, MIME_TYPE_TEXT, MIME_TYPE_JSON, MIME_TYPE_PROBLEM_JSON) {
+	case MIME_TYPE_JSON:
+		if env.conf.ProblemJson {
+			return errResJson(req, header, MIME_TYPE_PROBLEM_JSON, body.HttpStatus, body.ProblemRes(req))
+		}
+		return errResJson(req, header, MIME_TYPE_JSON, body.HttpStatus, body)
+
+	case MIME_TYPE_PROBLEM_JSON:
+		return errResJson(req, header, MIME_TYPE_PROBLEM_JSON, body.HttpStatus, body.ProblemRes(req))
+
+	default:
+		text := body.Message
+		pub, ok := errPub(err).(Error)
+		if ok && locale == "" {
+			text = pub.Error()
+		}
+		return goh.String{Status: body.HttpStatus, Header: header, Body: text}
+	}
+}
+
+// Tells clients when to retry errors that are expected to be transient.
+func errResHeader(status int) http.Header {
+	if status == http.StatusServiceUnavailable {
+		return httpHead("retry-after", intToString(RETRY_AFTER_SECONDS))
+	}
+	return nil
+}
+
+func errResJson(req *Req, header http.Header, contentType string, status int, body interface{}) Res {
+	bytes, err := jsonMarshal(body)
+	if err != nil {
+		logErrorCtx(req.Context(), err)
+		return goh.String{Status: status, Header: header, Body: http.StatusText(status)}
+	}
+	return goh.Bytes{
+		Status: status,
+		Header: patchHttpHeader(header, httpHead("content-type", contentType)),
+		Body:   bytes,
+	}
 }
 
 func writeResOrErr(rew Rew, req *Req, res Res, err error) {
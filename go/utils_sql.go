@@ -91,3 +91,27 @@ func sqlToSingleLine(input string) string {
 
 	return bytesToMutableString(buf)
 }
+
+// Removes comments, preserving everything else, including line breaks.
+func sqlStripComments(input string) string {
+	var buf []byte
+	tokenizer := sqlp.Tokenizer{Source: input}
+
+	for {
+		node := tokenizer.Next()
+		if node == nil {
+			break
+		}
+
+		switch node.(type) {
+		case sqlp.NodeCommentLine:
+			buf = append(buf, '\n')
+		case sqlp.NodeCommentBlock:
+			continue
+		default:
+			node.Append(&buf)
+		}
+	}
+
+	return bytesToMutableString(buf)
+}
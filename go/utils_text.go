@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -33,6 +35,39 @@ func randomLetters(count int) string {
 	return randomCharSample(LOWERCASE_LETTERS, count)
 }
 
+/*
+Makes `rand.Rand` safe for concurrent use, like the global "math/rand"
+functions, except for `.Read`, which has its own state. Unlike the global
+source, which is seeded with 1 before Go 1.20, ours is seeded explicitly, so
+different instances of the app don't produce the same sequence.
+*/
+type LockedRandSource struct {
+	lock sync.Mutex
+	src  rand.Source64
+}
+
+func NewLockedRandSource(seed int64) *LockedRandSource {
+	return &LockedRandSource{src: rand.NewSource(seed).(rand.Source64)}
+}
+
+func (self *LockedRandSource) Int63() int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.src.Int63()
+}
+
+func (self *LockedRandSource) Uint64() uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.src.Uint64()
+}
+
+func (self *LockedRandSource) Seed(seed int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.src.Seed(seed)
+}
+
 func formatTime(inst time.Time) string {
 	return inst.Format(time.RFC3339)
 }